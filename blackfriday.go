@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	blackfriday "gopkg.in/russross/blackfriday.v2"
+)
+
+var blackfridayExtensions = map[string]blackfriday.Extensions{
+	"no-intra-emphasis":    blackfriday.NoIntraEmphasis,
+	"tables":               blackfriday.Tables,
+	"fenced-code":          blackfriday.FencedCode,
+	"autolink":             blackfriday.Autolink,
+	"strikethrough":        blackfriday.Strikethrough,
+	"lax-html-blocks":      blackfriday.LaxHTMLBlocks,
+	"space-headings":       blackfriday.SpaceHeadings,
+	"hard-line-break":      blackfriday.HardLineBreak,
+	"tab-size-eight":       blackfriday.TabSizeEight,
+	"footnotes":            blackfriday.Footnotes,
+	"no-empty-line-before": blackfriday.NoEmptyLineBeforeBlock,
+	"heading-ids":          blackfriday.HeadingIDs,
+	"titleblock":           blackfriday.Titleblock,
+	"backslash-line-break": blackfriday.BackslashLineBreak,
+	"definition-lists":     blackfriday.DefinitionLists,
+}
+
+var blackfridayHtmlFlags = map[string]blackfriday.HTMLFlags{
+	"skip-html":                 blackfriday.SkipHTML,
+	"skip-images":               blackfriday.SkipImages,
+	"skip-links":                blackfriday.SkipLinks,
+	"safelink":                  blackfriday.Safelink,
+	"nofollow":                  blackfriday.NofollowLinks,
+	"noreferrer":                blackfriday.NoreferrerLinks,
+	"noopener":                  blackfriday.NoopenerLinks,
+	"target-blank":              blackfriday.HrefTargetBlank,
+	"footnote-return-links":     blackfriday.FootnoteReturnLinks,
+	"use-xhtml":                 blackfriday.UseXHTML,
+	"smartypants":               blackfriday.Smartypants,
+	"smartypants-fractions":     blackfriday.SmartypantsFractions,
+	"smartypants-dashes":        blackfriday.SmartypantsDashes,
+	"smartypants-latex-dashes":  blackfriday.SmartypantsLatexDashes,
+	"smartypants-angled-quotes": blackfriday.SmartypantsAngledQuotes,
+	"smartypants-quotes-nbsp":   blackfriday.SmartypantsQuotesNBSP,
+}
+
+// blackfridayRenderer renders markdown with blackfriday v2
+type blackfridayRenderer struct{}
+
+func (blackfridayRenderer) DefaultOptions() map[string]bool {
+	options := map[string]bool{"auto-heading-ids": true}
+	for name, extension := range blackfridayExtensions {
+		options[name] = blackfriday.CommonExtensions&extension != 0
+	}
+	for name, flag := range blackfridayHtmlFlags {
+		options[name] = blackfriday.CommonHTMLFlags&flag != 0
+	}
+	return options
+}
+
+func (blackfridayRenderer) Render(p *Page, content []byte, options map[string]bool) ([]byte, []Heading, error) {
+	var extensions blackfriday.Extensions
+	for name, extension := range blackfridayExtensions {
+		if options[name] {
+			extensions |= extension
+		}
+	}
+
+	var flags blackfriday.HTMLFlags
+	for name, flag := range blackfridayHtmlFlags {
+		if options[name] {
+			flags |= flag
+		}
+	}
+
+	markdown := blackfriday.New(blackfriday.WithExtensions(extensions))
+	root := markdown.Parse(content)
+	headings := assignHeadingIds(root, options["auto-heading-ids"])
+	if err := rewriteBlackfridayLinks(p, root); err != nil {
+		return nil, nil, err
+	}
+
+	renderer := newHtmlRenderer(p.Site, flags)
+	var buffer bytes.Buffer
+	renderer.RenderHeader(&buffer, root)
+	root.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		return renderer.RenderNode(&buffer, node, entering)
+	})
+	renderer.RenderFooter(&buffer, root)
+
+	return buffer.Bytes(), headings, nil
+}
+
+func rewriteBlackfridayLinks(p *Page, root *blackfriday.Node) (err error) {
+	root.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		switch node.Type {
+		case blackfriday.Link, blackfriday.Image:
+			if entering {
+				var link string
+				link, err = p.rewriteLink(string(node.LinkData.Destination))
+				node.LinkData.Destination = []byte(link)
+			}
+		case blackfriday.HTMLSpan, blackfriday.HTMLBlock:
+			node.Literal, err = p.rewriteHtmlLinks(node.Literal)
+		}
+		if err != nil {
+			return blackfriday.Terminate
+		}
+		return blackfriday.GoToNext
+	})
+	return err
+}
+
+// htmlRenderer is the blackfriday HTML renderer with syntax highlighting of
+// fenced code blocks
+type htmlRenderer struct {
+	*blackfriday.HTMLRenderer
+	site *Site
+}
+
+func newHtmlRenderer(site *Site, flags blackfriday.HTMLFlags) *htmlRenderer {
+	return &htmlRenderer{
+		HTMLRenderer: blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+			Flags: flags,
+		}),
+		site: site,
+	}
+}
+
+func (r *htmlRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type == blackfriday.CodeBlock {
+		if highlighted, ok := r.site.highlightCode(string(node.Info), node.Literal); ok {
+			w.Write(highlighted)
+			return blackfriday.GoToNext
+		}
+	}
+
+	if node.Type == blackfriday.Heading && !entering && r.site.headingLinks && node.HeadingID != "" {
+		fmt.Fprintf(w, `<a class="anchor" href="#%s" aria-hidden="true">#</a>`, node.HeadingID)
+	}
+
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+// assignHeadingIds gives every heading a unique id, unless it has a custom
+// one like "# Heading {#id}". Without auto, only custom ids are used.
+func assignHeadingIds(root *blackfriday.Node, auto bool) (headings []Heading) {
+	ids := make(headingIds)
+	root.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if node.Type != blackfriday.Heading || !entering {
+			return blackfriday.GoToNext
+		}
+
+		text := blackfridayText(node)
+		if auto || node.HeadingID != "" {
+			node.HeadingID = ids.unique(text, node.HeadingID)
+		}
+
+		headings = append(headings, Heading{Level: node.Level, Text: text, Id: node.HeadingID})
+		return blackfriday.SkipChildren
+	})
+	return headings
+}
+
+func blackfridayText(node *blackfriday.Node) string {
+	var text bytes.Buffer
+	node.Walk(func(child *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if entering && (child.Type == blackfriday.Text || child.Type == blackfriday.Code) {
+			text.Write(child.Literal)
+		}
+		return blackfriday.GoToNext
+	})
+	return text.String()
+}
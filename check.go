@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var reLinkTarget *regexp.Regexp = regexp.MustCompile(`\b(?:href|src)=["']([^"']*)["']`)
+var reAnchor *regexp.Regexp = regexp.MustCompile(`\b(?:id|name)=["']([^"']+)["']`)
+
+// BrokenLink is a link or image in the target which doesn't lead anywhere
+type BrokenLink struct {
+	File   string // Source file of the page if there is one, else the output file
+	Line   int
+	Target string
+	Reason string
+}
+
+func (l BrokenLink) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", l.File, l.Line, l.Reason, l.Target)
+}
+
+type linkChecker struct {
+	site    *Site
+	sources map[string]*Page           // Output file -> page
+	anchors map[string]map[string]bool // Output file -> anchor ids
+	broken  []BrokenLink
+}
+
+// reportBrokenLinks prints the broken links with "ply check" or
+// --check-links, and returns how many there are
+func (site *Site) reportBrokenLinks() (int, error) {
+	if !site.checkLinks {
+		return 0, nil
+	}
+
+	broken, err := site.CheckLinks()
+	if err != nil {
+		return 0, err
+	}
+	for _, link := range broken {
+		fmt.Println(link)
+	}
+	return len(broken), nil
+}
+
+// CheckLinks verifies that every internal link and image in the built HTML
+// files exists in the target, including #anchors in linked pages
+func (site *Site) CheckLinks() ([]BrokenLink, error) {
+	checker := &linkChecker{
+		site:    site,
+		sources: make(map[string]*Page),
+		anchors: make(map[string]map[string]bool),
+	}
+	for _, p := range site.allPages() {
+		checker.sources[p.Path.Abs] = p
+	}
+
+	err := filepath.Walk(site.TargetPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != site.TargetPath && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".html" {
+			return checker.checkFile(path)
+		}
+		return nil
+	})
+
+	return checker.broken, err
+}
+
+func (c *linkChecker) checkFile(absPath string) error {
+	content, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range reLinkTarget.FindAllSubmatchIndex(content, -1) {
+		target := string(content[m[2]:m[3]])
+		reason := c.checkTarget(absPath, target)
+		if reason == "" {
+			continue
+		}
+
+		link := BrokenLink{
+			File:   absPath,
+			Line:   bytes.Count(content[:m[0]], []byte("\n")) + 1,
+			Target: target,
+			Reason: reason,
+		}
+		if p := c.sources[absPath]; p != nil {
+			if file, line := c.sourceLine(p, target); line > 0 {
+				link.File, link.Line = file, line
+			}
+		}
+		c.broken = append(c.broken, link)
+	}
+
+	return nil
+}
+
+// checkTarget returns why a link target is broken, or an empty string
+func (c *linkChecker) checkTarget(absPath, target string) string {
+	u, err := url.Parse(html.UnescapeString(strings.TrimSpace(target)))
+	if err != nil {
+		return "invalid url"
+	}
+	if u.IsAbs() || u.Host != "" || u.Opaque != "" {
+		return "" // Not on this site
+	}
+
+	targetPath := absPath
+	if u.Path != "" {
+		if strings.HasPrefix(u.Path, "/") {
+			targetPath = filepath.Join(c.site.TargetPath, filepath.FromSlash(u.Path))
+		} else {
+			targetPath = filepath.Join(filepath.Dir(absPath), filepath.FromSlash(u.Path))
+		}
+
+		info, err := os.Stat(targetPath)
+		if err != nil {
+			return "missing file"
+		}
+		if info.IsDir() {
+			// Same layout as --pretty-urls produces: foo/ is foo/index.html
+			targetPath = filepath.Join(targetPath, "index.html")
+			if _, err := os.Stat(targetPath); err != nil {
+				return "missing index.html"
+			}
+		}
+	}
+
+	if u.Fragment != "" && filepath.Ext(targetPath) == ".html" {
+		anchors, err := c.anchorsOf(targetPath)
+		if err != nil {
+			return err.Error()
+		}
+		if !anchors[u.Fragment] {
+			return "missing anchor"
+		}
+	}
+
+	return ""
+}
+
+func (c *linkChecker) anchorsOf(absPath string) (map[string]bool, error) {
+	if anchors, ok := c.anchors[absPath]; ok {
+		return anchors, nil
+	}
+
+	content, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	anchors := make(map[string]bool)
+	for _, m := range reAnchor.FindAllSubmatch(content, -1) {
+		anchors[string(m[1])] = true
+	}
+	c.anchors[absPath] = anchors
+	return anchors, nil
+}
+
+// sourceLine finds the line in the markdown source of a page where a link
+// target was written, possibly as a .md link before it was rewritten
+func (c *linkChecker) sourceLine(p *Page, target string) (string, int) {
+	rel, err := filepath.Rel(c.site.TargetPath, p.Path.AbsSrc)
+	if err != nil {
+		return "", 0
+	}
+	source := filepath.Join(c.site.SourcePath, rel)
+
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		return "", 0 // Generated pages have no source
+	}
+	lines := strings.Split(string(content), "\n")
+
+	// Links to pages were rewritten from .md, and with --pretty-urls
+	// relative links are one level deeper
+	candidates := []string{target}
+	if u, err := url.Parse(target); err == nil && u.Path != "" {
+		base := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".html")
+		if base != "" && base != "." && base != ".." {
+			u.Path = base + ".md"
+			candidates = append(candidates, u.String(), strings.TrimPrefix(u.String(), "../"))
+		}
+	}
+
+	for _, candidate := range candidates {
+		for i, line := range lines {
+			if strings.Contains(line, candidate) {
+				return source, i + 1
+			}
+		}
+	}
+	return "", 0
+}
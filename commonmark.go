@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+var commonmarkExtensions = map[string]goldmark.Extender{
+	"tables":           extension.Table,
+	"strikethrough":    extension.Strikethrough,
+	"autolink":         extension.Linkify,
+	"task-lists":       extension.TaskList,
+	"footnotes":        extension.Footnote,
+	"definition-lists": extension.DefinitionList,
+	"smartypants":      extension.Typographer,
+}
+
+// commonmarkRenderer renders CommonMark with goldmark, by default with the
+// same extensions as GitHub
+type commonmarkRenderer struct{}
+
+func (commonmarkRenderer) DefaultOptions() map[string]bool {
+	return map[string]bool{
+		"tables":           true,
+		"strikethrough":    true,
+		"autolink":         true,
+		"task-lists":       true,
+		"footnotes":        false,
+		"definition-lists": false,
+		"smartypants":      false,
+		"heading-ids":      true,
+		"auto-heading-ids": true,
+		"hard-line-break":  false,
+		"skip-html":        false,
+		"use-xhtml":        false,
+		"nofollow":         false,
+		"noreferrer":       false,
+		"noopener":         false,
+		"target-blank":     false,
+	}
+}
+
+func (commonmarkRenderer) Render(p *Page, content []byte, options map[string]bool) ([]byte, []Heading, error) {
+	var extensions []goldmark.Extender
+	for name, extension := range commonmarkExtensions {
+		if options[name] {
+			extensions = append(extensions, extension)
+		}
+	}
+
+	var parserOptions []parser.Option
+	if options["heading-ids"] {
+		parserOptions = append(parserOptions, parser.WithAttribute())
+	}
+
+	rendererOptions := []renderer.Option{
+		renderer.WithNodeRenderers(util.Prioritized(&commonmarkNodeRenderer{p, !options["skip-html"]}, 100)),
+	}
+	// Raw HTML is written like blackfriday does, unless it's skipped
+	if !options["skip-html"] {
+		rendererOptions = append(rendererOptions, goldmarkhtml.WithUnsafe())
+	}
+	if options["hard-line-break"] {
+		rendererOptions = append(rendererOptions, goldmarkhtml.WithHardWraps())
+	}
+	if options["use-xhtml"] {
+		rendererOptions = append(rendererOptions, goldmarkhtml.WithXHTML())
+	}
+
+	markdown := goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithParserOptions(parserOptions...),
+		goldmark.WithRendererOptions(rendererOptions...),
+	)
+
+	root := markdown.Parser().Parse(text.NewReader(content))
+	headings, err := p.decorateCommonmark(root, content, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err := markdown.Renderer().Render(&buffer, content, root); err != nil {
+		return nil, nil, err
+	}
+	return buffer.Bytes(), headings, nil
+}
+
+// decorateCommonmark assigns heading ids and adds heading links, rewrites
+// links, and adds the rel and target attributes of links to other sites
+func (p *Page) decorateCommonmark(root ast.Node, source []byte, options map[string]bool) (headings []Heading, err error) {
+	var rel []byte
+	for _, name := range []string{"nofollow", "noreferrer", "noopener"} {
+		if options[name] {
+			if len(rel) > 0 {
+				rel = append(rel, ' ')
+			}
+			rel = append(rel, name...)
+		}
+	}
+
+	ids := make(headingIds)
+	err = ast.Walk(root, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch node := node.(type) {
+		case *ast.Heading:
+			text := commonmarkText(node, source)
+			var id string
+			if custom, ok := node.AttributeString("id"); ok {
+				id = ids.unique(text, string(custom.([]byte)))
+			} else if options["auto-heading-ids"] {
+				id = ids.unique(text, "")
+			}
+
+			if id != "" {
+				node.SetAttributeString("id", []byte(id))
+				if p.Site.headingLinks {
+					anchor := ast.NewString([]byte(fmt.Sprintf(`<a class="anchor" href="#%s" aria-hidden="true">#</a>`, id)))
+					anchor.SetCode(true) // Written as is
+					node.AppendChild(node, anchor)
+				}
+			}
+
+			headings = append(headings, Heading{Level: node.Level, Text: text, Id: id})
+			return ast.WalkSkipChildren, nil
+		case *ast.Link:
+			link, err := p.rewriteLink(string(node.Destination))
+			if err != nil {
+				return ast.WalkStop, err
+			}
+			node.Destination = []byte(link)
+			decorateLink(node, node.Destination, rel, options["target-blank"])
+		case *ast.Image:
+			link, err := p.rewriteLink(string(node.Destination))
+			if err != nil {
+				return ast.WalkStop, err
+			}
+			node.Destination = []byte(link)
+		case *ast.AutoLink:
+			decorateLink(node, node.URL(source), rel, options["target-blank"])
+		}
+		return ast.WalkContinue, nil
+	})
+	return headings, err
+}
+
+func decorateLink(node ast.Node, destination []byte, rel []byte, targetBlank bool) {
+	if u, err := url.Parse(string(destination)); err != nil || !u.IsAbs() {
+		return
+	}
+	if len(rel) > 0 {
+		node.SetAttributeString("rel", rel)
+	}
+	if targetBlank {
+		node.SetAttributeString("target", []byte("_blank"))
+	}
+}
+
+func commonmarkText(node ast.Node, source []byte) string {
+	var text bytes.Buffer
+	ast.Walk(node, func(child ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			switch child := child.(type) {
+			case *ast.Text:
+				text.Write(child.Segment.Value(source))
+			case *ast.String:
+				text.Write(child.Value)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return text.String()
+}
+
+// commonmarkNodeRenderer highlights fenced code blocks, like htmlRenderer
+// does for blackfriday, and rewrites links in raw HTML
+type commonmarkNodeRenderer struct {
+	page   *Page
+	unsafe bool // Raw HTML is written, see goldmarkhtml.WithUnsafe
+}
+
+func (r *commonmarkNodeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
+	reg.Register(ast.KindRawHTML, r.renderRawHTML)
+}
+
+func (r *commonmarkNodeRenderer) renderHTMLBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.HTMLBlock)
+	if !entering && !n.HasClosure() {
+		return ast.WalkContinue, nil
+	} else if !r.unsafe {
+		w.WriteString("<!-- raw HTML omitted -->\n")
+		return ast.WalkContinue, nil
+	}
+
+	var content []byte
+	if entering {
+		for i := 0; i < n.Lines().Len(); i++ {
+			line := n.Lines().At(i)
+			content = append(content, line.Value(source)...)
+		}
+	} else {
+		content = n.ClosureLine.Value(source)
+	}
+	content, err := r.page.rewriteHtmlLinks(content)
+	w.Write(content)
+	return ast.WalkContinue, err
+}
+
+func (r *commonmarkNodeRenderer) renderRawHTML(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	} else if !r.unsafe {
+		w.WriteString("<!-- raw HTML omitted -->")
+		return ast.WalkSkipChildren, nil
+	}
+
+	n := node.(*ast.RawHTML)
+	var content []byte
+	for i := 0; i < n.Segments.Len(); i++ {
+		segment := n.Segments.At(i)
+		content = append(content, segment.Value(source)...)
+	}
+	content, err := r.page.rewriteHtmlLinks(content)
+	w.Write(content)
+	return ast.WalkSkipChildren, err
+}
+
+func (r *commonmarkNodeRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	n := node.(*ast.FencedCodeBlock)
+	var info string
+	if n.Info != nil {
+		info = string(n.Info.Segment.Value(source))
+	}
+
+	var code bytes.Buffer
+	for i := 0; i < n.Lines().Len(); i++ {
+		line := n.Lines().At(i)
+		code.Write(line.Value(source))
+	}
+
+	if highlighted, ok := r.page.Site.highlightCode(info, code.Bytes()); ok {
+		w.Write(highlighted)
+		return ast.WalkSkipChildren, nil
+	}
+
+	w.WriteString("<pre><code")
+	if language := n.Language(source); language != nil {
+		fmt.Fprintf(w, ` class="language-%s"`, html.EscapeString(string(language)))
+	}
+	w.WriteString(">")
+	w.WriteString(html.EscapeString(code.String()))
+	w.WriteString("</code></pre>\n")
+	return ast.WalkSkipChildren, nil
+}
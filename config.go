@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/atmoz/ply/fileutil"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configFile in .ply, or dirConfigFile in the source root, sets the options
+// of the site. Options given on the command line win.
+const configFile string = "config.yaml"
+
+// dirConfigFile in a directory overrides the page options and params for the
+// pages in it and below, the same way ply.template files are applied
+const dirConfigFile string = "ply.yaml"
+
+type dirConfig struct {
+	Renderer         string                 `yaml:"renderer"`
+	Markdown         []string               `yaml:"markdown"`
+	TemplateMarkdown *bool                  `yaml:"template-markdown"`
+	Params           map[string]interface{} `yaml:"params"`
+}
+
+type siteConfig struct {
+	dirConfig `yaml:",inline"`
+
+	Title            string   `yaml:"title"`
+	BaseUrl          string   `yaml:"base-url"`
+	Ignore           []string `yaml:"ignore"`
+	IncludeMarkdown  bool     `yaml:"include-markdown"`
+	IncludeTemplate  bool     `yaml:"include-template"`
+	PrettyUrls       bool     `yaml:"pretty-urls"`
+	KeepLinks        bool     `yaml:"keep-links"`
+	AllowExec        bool     `yaml:"allow-exec"`
+	Drafts           bool     `yaml:"drafts"`
+	Future           bool     `yaml:"future"`
+	Expired          bool     `yaml:"expired"`
+	Highlight        string   `yaml:"highlight"`
+	HighlightClasses bool     `yaml:"highlight-classes"`
+	LineNumbers      bool     `yaml:"line-numbers"`
+	HeadingLinks     bool     `yaml:"heading-links"`
+	Search           bool     `yaml:"search"`
+	SearchFields     []string `yaml:"search-fields"`
+	Redirects        string   `yaml:"redirects"`
+	Paginate         int      `yaml:"paginate"`
+	Jobs             int      `yaml:"jobs"`
+	Incremental      bool     `yaml:"incremental"`
+	Sync             bool     `yaml:"sync"`
+	DryRun           bool     `yaml:"dry-run"`
+}
+
+// configure applies the config file on top of the options given as flags,
+// and checks the options. Watch calls it again before every rebuild, so
+// changes to the config file are picked up.
+func (site *Site) configure() error {
+	if site.flags == nil {
+		site.flags = site.flagOptions()
+	}
+
+	config, err := site.readConfig()
+	if err != nil {
+		return err
+	}
+	if err := site.applyOptions(site.flags, config); err != nil {
+		return err
+	}
+
+	site.copyOptions = new(fileutil.CopyOptions)
+	ignore := site.flags.Ignore
+	if ignore == nil {
+		ignore = config.Ignore
+	}
+	if ignore == nil {
+		ignore = []string{defaultIgnore}
+	}
+	for _, pattern := range ignore {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		site.copyOptions.IgnoreRegex = append(site.copyOptions.IgnoreRegex, re)
+	}
+	site.copyOptions.IgnoreRegex = append(
+		site.copyOptions.IgnoreRegex, regexp.MustCompile("^"+regexp.QuoteMeta(site.TargetPath)))
+	site.copyOptions.OnCopy = site.markWritten
+
+	for _, check := range []func() error{site.checkSync, site.checkHighlightStyle, site.checkMarkdown, site.checkRedirects, site.checkSearch} {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readConfig reads .ply/config.yaml or ply.yaml, if there is one
+func (site *Site) readConfig() (*siteConfig, error) {
+	var name string
+	var content []byte
+	for _, path := range []string{filepath.Join(site.plyPath, configFile), filepath.Join(site.SourcePath, dirConfigFile)} {
+		c, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if content != nil {
+			return nil, errors.New("Only one of " + name + " and " + path + " can be used")
+		}
+		name, content = path, c
+	}
+
+	config := new(siteConfig)
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	return config, nil
+}
+
+// flagOptions returns the options set before the config file is applied,
+// which are those given as flags
+func (site *Site) flagOptions() *siteConfig {
+	flags := &siteConfig{
+		dirConfig: dirConfig{
+			Renderer:         site.renderer,
+			Markdown:         site.markdown,
+			TemplateMarkdown: &site.templateMarkdown,
+			Params:           site.Params,
+		},
+		Title:            site.Title,
+		BaseUrl:          site.baseUrl,
+		IncludeMarkdown:  site.includeMarkdown,
+		IncludeTemplate:  site.includeTemplate,
+		PrettyUrls:       site.prettyUrls,
+		KeepLinks:        site.keepLinks,
+		AllowExec:        site.allowExec,
+		Drafts:           site.buildDrafts,
+		Future:           site.buildFuture,
+		Expired:          site.buildExpired,
+		Highlight:        site.highlightStyle,
+		HighlightClasses: site.highlightClasses,
+		LineNumbers:      site.lineNumbers,
+		HeadingLinks:     site.headingLinks,
+		Search:           site.search,
+		SearchFields:     site.searchFields,
+		Redirects:        site.redirects,
+		Paginate:         site.paginate,
+		Jobs:             site.jobs,
+		Incremental:      site.incremental,
+		Sync:             site.sync,
+		DryRun:           site.dryRun,
+	}
+	flag := *flags.TemplateMarkdown
+	flags.TemplateMarkdown = &flag
+
+	if site.copyOptions != nil {
+		for _, re := range site.copyOptions.IgnoreRegex {
+			flags.Ignore = append(flags.Ignore, re.String())
+		}
+	}
+	return flags
+}
+
+// applyOptions sets the options from flags, or else from the config file.
+// Options turned on in the config file are turned off by --no-<option>.
+func (site *Site) applyOptions(flags, config *siteConfig) error {
+	known := make(map[string]bool)
+	on := func(name string, flag bool, config bool) bool {
+		known[name] = true
+		return flag || config && !site.disabled[name]
+	}
+
+	site.includeMarkdown = on("include-markdown", flags.IncludeMarkdown, config.IncludeMarkdown)
+	site.includeTemplate = on("include-template", flags.IncludeTemplate, config.IncludeTemplate)
+	site.prettyUrls = on("pretty-urls", flags.PrettyUrls, config.PrettyUrls)
+	site.keepLinks = on("keep-links", flags.KeepLinks, config.KeepLinks)
+	site.allowExec = on("allow-exec", flags.AllowExec, config.AllowExec)
+	site.buildDrafts = on("drafts", flags.Drafts, config.Drafts)
+	site.buildFuture = on("future", flags.Future, config.Future)
+	site.buildExpired = on("expired", flags.Expired, config.Expired)
+	site.highlightClasses = on("highlight-classes", flags.HighlightClasses, config.HighlightClasses)
+	site.lineNumbers = on("line-numbers", flags.LineNumbers, config.LineNumbers)
+	site.headingLinks = on("heading-links", flags.HeadingLinks, config.HeadingLinks)
+	site.search = on("search", flags.Search, config.Search)
+	site.incremental = on("incremental", flags.Incremental, config.Incremental)
+	site.sync = on("sync", flags.Sync, config.Sync)
+	site.dryRun = on("dry-run", flags.DryRun, config.DryRun)
+	site.templateMarkdown = on("template-markdown", *flags.TemplateMarkdown, config.TemplateMarkdown != nil && *config.TemplateMarkdown)
+
+	for name := range site.disabled {
+		if !known[name] {
+			return errors.New("Unknown option: --no-" + name)
+		}
+	}
+
+	site.Title = orString(flags.Title, config.Title)
+	site.baseUrl = orString(flags.BaseUrl, config.BaseUrl)
+	site.highlightStyle = orString(flags.Highlight, config.Highlight)
+	site.renderer = orString(flags.Renderer, config.Renderer)
+	site.redirects = orString(flags.Redirects, config.Redirects)
+
+	site.Params = flags.Params
+	if site.Params == nil {
+		site.Params = config.Params
+	}
+	if site.Params == nil {
+		site.Params = make(map[string]interface{})
+	}
+	site.markdown = flags.Markdown
+	if site.markdown == nil {
+		site.markdown = config.Markdown
+	}
+	site.searchFields = flags.SearchFields
+	if site.searchFields == nil {
+		site.searchFields = config.SearchFields
+	}
+
+	site.paginate = flags.Paginate
+	if site.paginate == 0 {
+		site.paginate = config.Paginate
+	}
+	site.jobs = flags.Jobs
+	if site.jobs == 0 {
+		site.jobs = config.Jobs
+	}
+	return nil
+}
+
+func orString(flag, config string) string {
+	if flag != "" {
+		return flag
+	}
+	return config
+}
+
+// addDirConfig reads a ply.yaml below the source root
+func (site *Site) addDirConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	rel, _ := filepath.Rel(site.TargetPath, path)
+	config := new(dirConfig)
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return errors.New(rel + ": " + err.Error())
+	}
+	if _, err := getRenderer(config.Renderer); err != nil {
+		return errors.New(rel + ": " + err.Error())
+	}
+
+	site.dirConfigs[filepath.Dir(path)] = config
+	return nil
+}
+
+// dirConfigsOf returns the ply.yaml configs applying to a directory, from
+// the one closest to the root
+func (site *Site) dirConfigsOf(dir string) (configs []*dirConfig) {
+	for {
+		if config := site.dirConfigs[dir]; config != nil {
+			configs = append([]*dirConfig{config}, configs...)
+		}
+
+		if rel, err := filepath.Rel(site.TargetPath, dir); err != nil || rel == "." {
+			return configs
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Params returns the params of the site config, with those of the ply.yaml
+// files of the page directory and its parents on top
+func (p *Page) Params() map[string]interface{} {
+	params := make(map[string]interface{})
+	for key, value := range p.Site.Params {
+		params[key] = value
+	}
+	for _, config := range p.Site.dirConfigsOf(filepath.Dir(p.Path.AbsSrc)) {
+		for key, value := range config.Params {
+			params[key] = value
+		}
+	}
+	return params
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// dataDir in .ply, or else in the source root, has data files for templates
+const dataDir string = "data"
+
+// loadData reads every data file in the data directory into .Site.Data,
+// keyed by path, e.g. data/authors/jane.yaml is .Site.Data.authors.jane. It's
+// done on every build, so changes are picked up by --watch.
+func (site *Site) loadData() error {
+	site.Data = make(map[string]interface{})
+
+	root := filepath.Join(site.plyPath, dataDir)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		root = filepath.Join(site.SourcePath, dataDir)
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return nil
+		}
+	}
+
+	return filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if path == root {
+			return nil
+		} else if strings.HasPrefix(f.Name(), ".") {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if f.IsDir() {
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if !isDataExt(ext) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		value, err := decodeData(ext, content)
+		if err != nil {
+			return errors.New(dataDir + "/" + filepath.ToSlash(rel) + ": " + err.Error())
+		}
+
+		// Add to the tree, with a map for every directory
+		keys := strings.Split(filepath.ToSlash(strings.TrimSuffix(rel, ext)), "/")
+		tree := site.Data
+		for _, key := range keys[:len(keys)-1] {
+			if tree[key] == nil {
+				tree[key] = make(map[string]interface{})
+			}
+			sub, ok := tree[key].(map[string]interface{})
+			if !ok {
+				return errors.New(dataDir + "/" + filepath.ToSlash(rel) + ": \"" + key + "\" is already a file")
+			}
+			tree = sub
+		}
+		key := keys[len(keys)-1]
+		if tree[key] != nil {
+			return errors.New(dataDir + "/" + filepath.ToSlash(rel) + ": \"" + key + "\" is already used")
+		}
+		tree[key] = value
+		return nil
+	})
+}
+
+// dataKey changes whenever .Site.Data changes
+func (site *Site) dataKey() string {
+	h := sha1.New()
+	fmt.Fprint(h, site.Data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isDataExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml", ".json", ".toml", ".csv":
+		return true
+	}
+	return false
+}
+
+// decodeData decodes YAML, JSON, TOML or CSV content by file extension. The
+// first row of CSV is the header, and the other rows maps keyed by it.
+func decodeData(ext string, content []byte) (data interface{}, err error) {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &data)
+	case ".json":
+		err = json.Unmarshal(content, &data)
+	case ".toml":
+		var table map[string]interface{}
+		err = toml.Unmarshal(content, &table)
+		data = table
+	case ".csv":
+		data, err = decodeCsv(content)
+	default:
+		err = errors.New("unknown data format \"" + ext + "\"")
+	}
+	return data, err
+}
+
+func decodeCsv(content []byte) ([]map[string]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil || len(records) == 0 {
+		return []map[string]string{}, err
+	}
+
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
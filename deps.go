@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The build cache lives in the target, so wiping the target also forces a
+// full rebuild.
+const buildCacheName string = ".ply.deps"
+
+// Templates matching this may read other pages, and must be re-rendered
+// whenever any page changes.
+var reSiteUsage *regexp.Regexp = regexp.MustCompile(`\b(Sitemap|SitemapReversed|Site|hasPage|hasFileOrPage)\b`)
+
+// pageDeps records everything a page read and wrote while being rendered
+type pageDeps struct {
+	Files    []string `json:"files"`
+	Outputs  []string `json:"outputs"`
+	Site     bool     `json:"site"`
+	Volatile bool     `json:"volatile"`
+}
+
+func (d *pageDeps) addFile(absPath string) {
+	for _, f := range d.Files {
+		if f == absPath {
+			return
+		}
+	}
+	d.Files = append(d.Files, absPath)
+}
+
+func (d *pageDeps) addOutput(absPath string) {
+	for _, f := range d.Outputs {
+		if f == absPath {
+			return
+		}
+	}
+	d.Outputs = append(d.Outputs, absPath)
+}
+
+func (d *pageDeps) merge(other *pageDeps) {
+	for _, f := range other.Files {
+		d.addFile(f)
+	}
+	for _, f := range other.Outputs {
+		d.addOutput(f)
+	}
+	d.Site = d.Site || other.Site
+	d.Volatile = d.Volatile || other.Volatile
+}
+
+type buildCache struct {
+	Options string               `json:"options"`
+	Index   string               `json:"index"`
+	Hashes  map[string]string    `json:"hashes"`
+	Pages   map[string]*pageDeps `json:"pages"`
+
+	hashes map[string]string // Hashes of the current build
+}
+
+func newBuildCache() *buildCache {
+	return &buildCache{
+		Hashes: make(map[string]string),
+		Pages:  make(map[string]*pageDeps),
+		hashes: make(map[string]string),
+	}
+}
+
+func (site *Site) buildCachePath() string {
+	return filepath.Join(site.TargetPath, buildCacheName)
+}
+
+func (site *Site) loadBuildCache() *buildCache {
+	cache := newBuildCache()
+	content, err := ioutil.ReadFile(site.buildCachePath())
+	if err != nil {
+		return cache
+	}
+
+	if err := json.Unmarshal(content, cache); err != nil {
+		fmt.Println("Ignoring broken build cache:", err)
+		return newBuildCache()
+	}
+	if cache.Hashes == nil || cache.Pages == nil {
+		return newBuildCache()
+	}
+	cache.hashes = make(map[string]string)
+	return cache
+}
+
+func (site *Site) saveBuildCache(pages map[string]*pageDeps) error {
+	cache := newBuildCache()
+	cache.Options = site.optionsKey()
+	cache.Index = site.indexKey()
+	cache.Pages = pages
+	for _, deps := range pages {
+		for _, f := range deps.Files {
+			cache.Hashes[f] = site.cache.hash(f)
+		}
+	}
+
+	content, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(site.buildCachePath(), content, defaultFileMode)
+}
+
+// hash returns the content hash of a file, or an empty string if it can't be read
+func (cache *buildCache) hash(absPath string) string {
+	if h, ok := cache.hashes[absPath]; ok {
+		return h
+	}
+
+	h := ""
+	if content, err := ioutil.ReadFile(absPath); err == nil {
+		sum := sha1.Sum(content)
+		h = hex.EncodeToString(sum[:])
+	}
+	cache.hashes[absPath] = h
+	return h
+}
+
+// optionsKey changes whenever an option affecting rendered output changes
+func (site *Site) optionsKey() string {
+	return fmt.Sprint(site.prettyUrls, site.keepLinks, site.allowExec, site.buildDrafts, site.buildFuture, site.buildExpired, site.taxonomies, site.paginate,
+		site.highlightStyle, site.highlightClasses, site.lineNumbers, site.headingLinks, site.renderer, site.markdown, site.templateMarkdown, site.baseUrl,
+		site.Title, site.Params, site.dirConfigsKey(), site.dataKey())
+}
+
+// dirConfigsKey changes whenever a ply.yaml changes
+func (site *Site) dirConfigsKey() string {
+	dirs := make([]string, 0, len(site.dirConfigs))
+	for dir := range site.dirConfigs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var key strings.Builder
+	for _, dir := range dirs {
+		c := site.dirConfigs[dir]
+		fmt.Fprint(&key, dir, c.Renderer, c.Markdown, c.TemplateMarkdown != nil && *c.TemplateMarkdown, c.TemplateMarkdown == nil, c.Params)
+	}
+	return key.String()
+}
+
+// indexKey changes whenever the list of pages or their metadata changes
+func (site *Site) indexKey() string {
+	h := sha1.New()
+	for _, p := range site.allPages() {
+		meta, _ := json.Marshal(p.Meta)
+		fmt.Fprintln(h, p.Path.Rel, p.Title, string(meta))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dirtyPages returns the pages that must be rendered, based on what they
+// depended on in the previous build
+func (site *Site) dirtyPages() map[*Page]bool {
+	dirty := make(map[*Page]bool)
+	cache := site.cache
+	fullRebuild := cache.Options != site.optionsKey()
+
+	pages := site.allPages()
+	anyDirty := fullRebuild || cache.Index != site.indexKey() || len(cache.Pages) != len(pages)
+	for _, p := range pages {
+		if fullRebuild || site.pageChanged(p) {
+			dirty[p] = true
+			anyDirty = true
+		}
+	}
+
+	if anyDirty {
+		for _, p := range pages {
+			if deps := cache.Pages[p.Path.Rel]; deps != nil && deps.Site {
+				dirty[p] = true
+			}
+		}
+	}
+
+	return dirty
+}
+
+func (site *Site) pageChanged(p *Page) bool {
+	deps := site.cache.Pages[p.Path.Rel]
+	if deps == nil || deps.Volatile {
+		return true
+	}
+
+	for _, f := range deps.Files {
+		if site.cache.hash(f) != site.cache.Hashes[f] {
+			return true
+		}
+	}
+
+	for _, f := range deps.Outputs {
+		if _, err := os.Stat(f); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
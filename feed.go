@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Feed formats, in the order they are written, and their file names
+var feedFormats = []string{"atom", "rss", "json"}
+var feedFiles = map[string]string{
+	"atom": "atom.xml",
+	"rss":  "rss.xml",
+	"json": "feed.json",
+}
+
+var reFirstParagraph *regexp.Regexp = regexp.MustCompile(`(?s)<p>.*?</p>`)
+
+type feedEntry struct {
+	Title   string
+	Url     string
+	Date    time.Time
+	Author  string
+	Tags    []string
+	Content string // HTML with absolute links
+	Summary bool   // Content is a summary
+}
+
+type feed struct {
+	Title   string
+	Url     string // Url of the page asking for the feed
+	FeedUrl string
+	Author  string
+	Updated time.Time
+	Entries []*feedEntry
+}
+
+// Date returns the "date" metadata of the page, or else the publishDate
+func (p *Page) Date() time.Time {
+	if date, err := p.metaTime("date"); err == nil && !date.IsZero() {
+		return date
+	}
+	return p.PublishDate
+}
+
+// feedFormats returns the formats asked for with the "feed" metadata, which
+// is true for all formats, or a list of them
+func (p *Page) feedFormats() ([]string, error) {
+	var names []string
+	switch value := p.Meta["feed"].(type) {
+	case nil:
+	case bool:
+		if value {
+			names = append([]string(nil), feedFormats...)
+		}
+	case string:
+		names = strings.Split(value, ",")
+	case []interface{}:
+		for _, name := range value {
+			names = append(names, fmt.Sprint(name))
+		}
+	default:
+		return nil, errors.New(p.Path.Rel + ": metadata \"feed\" must be true or a list of formats")
+	}
+
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if feedFiles[names[i]] == "" {
+			return nil, errors.New(p.Path.Rel + ": unknown feed format \"" + names[i] + "\"")
+		}
+	}
+	return names, nil
+}
+
+// writeFeeds writes the feeds pages ask for with the "feed" metadata, in the
+// directory of the page. Generated taxonomy pages get it from the front
+// matter of their template. A page in a taxonomy term directory like
+// tags/go/index.md gets a feed of the pages with that term, other pages a
+// feed of the pages in their directory and below.
+func (site *Site) writeFeeds() error {
+	for _, p := range site.allPages() {
+		formats, err := p.feedFormats()
+		if err != nil {
+			return err
+		} else if len(formats) == 0 {
+			continue
+		}
+		if site.baseUrl == "" {
+			return errors.New(p.Path.Rel + ": feeds need --base-url")
+		}
+
+		f, err := site.newFeed(p)
+		if err != nil {
+			return err
+		}
+
+		for _, format := range formats {
+			absPath := filepath.Join(p.Path.AbsDir, feedFiles[format])
+			site.lock.RLock()
+			taken := site.written[absPath]
+			site.lock.RUnlock()
+			if taken {
+				return errors.New(p.Path.Rel + ": feed would overwrite " + absPath)
+			}
+
+			f.FeedUrl = site.absUrlOf(absPath)
+			var content []byte
+			switch format {
+			case "atom":
+				content, err = f.atom()
+			case "rss":
+				content, err = f.rss()
+			case "json":
+				content, err = f.json()
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := ioutil.WriteFile(absPath, content, defaultFileMode); err != nil {
+				return err
+			}
+			fmt.Println("Feed:", absPath)
+			site.markWritten(absPath)
+		}
+	}
+	return nil
+}
+
+func (site *Site) newFeed(p *Page) (*feed, error) {
+	f := &feed{Title: p.Title, Url: site.AbsUrl(p), Updated: site.lastmod(p)}
+	f.Author, _ = p.Meta["author"].(string)
+
+	summary := p.Meta["feedContent"] == "summary"
+	for _, entry := range site.feedPages(p) {
+		e, err := site.newFeedEntry(entry, summary)
+		if err != nil {
+			return nil, err
+		}
+		f.Entries = append(f.Entries, e)
+	}
+
+	sort.SliceStable(f.Entries, func(i, j int) bool {
+		if f.Entries[i].Date.Equal(f.Entries[j].Date) {
+			return f.Entries[i].Url < f.Entries[j].Url
+		}
+		return f.Entries[i].Date.After(f.Entries[j].Date)
+	})
+	if len(f.Entries) > 0 {
+		f.Updated = f.Entries[0].Date
+	}
+	return f, nil
+}
+
+// feedPages returns the pages in the feed of a page
+func (site *Site) feedPages(p *Page) []*Page {
+	if data, ok := p.Data.(*TermData); ok {
+		if data.Term != "" {
+			return data.Pages
+		}
+		return termsPages(data.Terms)
+	}
+
+	parts := strings.Split(filepath.ToSlash(filepath.Dir(site.srcRel(p))), "/")
+	if len(parts) == 2 && filepath.Base(p.Path.AbsSrc) == "index.md" {
+		for taxonomy, terms := range site.Taxonomies {
+			if slugify(taxonomy) != parts[0] {
+				continue
+			}
+			var pages []*Page
+			for term, termPages := range terms {
+				if slugify(term) == parts[1] {
+					pages = append(pages, termPages...)
+				}
+			}
+			if len(pages) > 0 {
+				return pages
+			}
+		}
+	}
+
+	var pages []*Page
+	dir := filepath.Dir(p.Path.AbsSrc) + string(filepath.Separator)
+	for _, other := range site.Pages {
+		if formats, _ := other.feedFormats(); other == p || len(formats) > 0 {
+			continue // Pages with feeds are listings
+		}
+		if strings.HasPrefix(other.Path.AbsSrc, dir) {
+			pages = append(pages, other)
+		}
+	}
+	return pages
+}
+
+// termsPages returns the pages with any of the terms, once each
+func termsPages(terms map[string][]*Page) []*Page {
+	var pages []*Page
+	seen := make(map[*Page]bool)
+	for _, termPages := range terms {
+		for _, p := range termPages {
+			if !seen[p] {
+				seen[p] = true
+				pages = append(pages, p)
+			}
+		}
+	}
+	return pages
+}
+
+func (site *Site) newFeedEntry(p *Page, summary bool) (*feedEntry, error) {
+	e := &feedEntry{Title: p.Title, Url: site.AbsUrl(p), Date: p.Date(), Tags: p.tags, Summary: summary}
+	e.Author, _ = p.Meta["author"].(string)
+	if e.Date.IsZero() {
+		e.Date = site.modTime(p)
+	}
+
+	content, err := p.ContentBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if summary {
+		if text, ok := p.Meta["summary"].(string); ok {
+			content = []byte("<p>" + html.EscapeString(text) + "</p>")
+		} else if paragraph := reFirstParagraph.Find(content); paragraph != nil {
+			content = paragraph
+		} else {
+			content = []byte("<p>" + html.EscapeString(plainText(content)) + "</p>")
+		}
+	}
+
+	base, err := url.Parse(e.Url)
+	if err != nil {
+		return nil, err
+	}
+	e.Content = string(absoluteLinks(content, base))
+	return e, nil
+}
+
+// absoluteLinks resolves relative href and src attributes from base, so they
+// work in feed readers
+func absoluteLinks(content []byte, base *url.URL) []byte {
+	return reHtmlLink.ReplaceAllFunc(content, func(attribute []byte) []byte {
+		m := reHtmlLink.FindSubmatch(attribute)
+		quote := string(m[2][:1])
+		link, err := url.Parse(html.UnescapeString(string(m[2][1 : len(m[2])-1])))
+		if err != nil || link.IsAbs() {
+			return attribute
+		}
+		return []byte(string(m[1]) + quote + htmlEscaper.Replace(base.ResolveReference(link).String()) + quote)
+	})
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Summary *atomText   `xml:"summary,omitempty"`
+	Content *atomText   `xml:"content,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func (f *feed) atom() ([]byte, error) {
+	a := atomFeed{
+		Title:   f.Title,
+		Id:      f.FeedUrl,
+		Links:   []atomLink{{Href: f.Url}, {Href: f.FeedUrl, Rel: "self"}},
+		Updated: f.Updated.Format(time.RFC3339),
+	}
+	if f.Author != "" {
+		a.Author = &atomPerson{f.Author}
+	} else {
+		a.Author = &atomPerson{f.Title} // Required by Atom
+	}
+
+	for _, e := range f.Entries {
+		entry := atomEntry{
+			Title:   e.Title,
+			Id:      e.Url,
+			Link:    atomLink{Href: e.Url},
+			Updated: e.Date.Format(time.RFC3339),
+		}
+		if e.Author != "" {
+			entry.Author = &atomPerson{e.Author}
+		}
+		if e.Summary {
+			entry.Summary = &atomText{"html", e.Content}
+		} else {
+			entry.Content = &atomText{"html", e.Content}
+		}
+		a.Entries = append(a.Entries, entry)
+	}
+
+	return marshalXml(a)
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Guid        string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Guid        rssGuid  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	AtomLink      rssAtomLink `xml:"http://www.w3.org/2005/Atom link"`
+	LastBuildDate string      `xml:"lastBuildDate"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func (f *feed) rss() ([]byte, error) {
+	r := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:         f.Title,
+		Link:          f.Url,
+		Description:   f.Title,
+		AtomLink:      rssAtomLink{Href: f.FeedUrl, Rel: "self", Type: "application/rss+xml"},
+		LastBuildDate: f.Updated.Format(time.RFC1123Z),
+	}}
+
+	for _, e := range f.Entries {
+		r.Channel.Items = append(r.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.Url,
+			Guid:        rssGuid{true, e.Url},
+			PubDate:     e.Date.Format(time.RFC1123Z),
+			Categories:  e.Tags,
+			Description: e.Content,
+		})
+	}
+
+	return marshalXml(r)
+}
+
+func marshalXml(v interface{}) ([]byte, error) {
+	content, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(content, '\n')...), nil
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	Id            string           `json:"id"`
+	Url           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHtml   string           `json:"content_html"`
+	DatePublished string           `json:"date_published"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageUrl string           `json:"home_page_url"`
+	FeedUrl     string           `json:"feed_url"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+func (f *feed) json() ([]byte, error) {
+	j := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageUrl: f.Url,
+		FeedUrl:     f.FeedUrl,
+		Items:       []jsonFeedItem{},
+	}
+	if f.Author != "" {
+		j.Authors = []jsonFeedAuthor{{f.Author}}
+	}
+
+	for _, e := range f.Entries {
+		item := jsonFeedItem{
+			Id:            e.Url,
+			Url:           e.Url,
+			Title:         e.Title,
+			DatePublished: e.Date.Format(time.RFC3339),
+			Tags:          e.Tags,
+		}
+		item.ContentHtml = e.Content
+		if e.Author != "" {
+			item.Authors = []jsonFeedAuthor{{e.Author}}
+		}
+		j.Items = append(j.Items, item)
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(j)
+	return buffer.Bytes(), err
+}
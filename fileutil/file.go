@@ -11,36 +11,47 @@ func CopyFile(from, to string, options *CopyOptions) error {
 		return err
 	}
 
+	if options != nil {
+		for _, regex := range options.IgnoreRegex {
+			if regex.MatchString(from) {
+				return nil
+			}
+		}
+	}
+
 	toInfo, toErr := os.Stat(to)
-	if os.IsExist(toErr) {
+	if toErr == nil {
 		hasMod := fromInfo.ModTime().After(toInfo.ModTime())
 		diffSize := fromInfo.Size() != toInfo.Size()
 
 		if !hasMod && !diffSize {
+			copied(to, options)
 			return nil // Skip
 		}
 	}
 
-	if options != nil {
-		for _, regex := range options.IgnoreRegex {
-			if regex.MatchString(from) {
-				return nil
-			}
-		}
-	}
-
 	fromFile, err := os.Open(from)
 	if err != nil {
 		return err
 	}
 	defer fromFile.Close()
 
-	toFile, err := os.OpenFile(to, os.O_CREATE|os.O_RDWR, fromInfo.Mode())
+	toFile, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_RDWR, fromInfo.Mode())
 	if err != nil {
 		return err
 	}
 	defer toFile.Close()
 
-	_, err = io.Copy(toFile, fromFile)
-	return err
+	if _, err = io.Copy(toFile, fromFile); err != nil {
+		return err
+	}
+
+	copied(to, options)
+	return nil
+}
+
+func copied(to string, options *CopyOptions) {
+	if options != nil && options.OnCopy != nil {
+		options.OnCopy(to)
+	}
 }
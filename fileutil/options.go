@@ -4,4 +4,8 @@ import "regexp"
 
 type CopyOptions struct {
 	IgnoreRegex []*regexp.Regexp
+
+	// OnCopy is called with the target path of every file that was copied
+	// or already up to date
+	OnCopy func(to string)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// Attributes after the language of a fenced code block, e.g.
+// ```go {linenos=true hl_lines="2 4-6" linenostart=10}
+var reCodeAttribute *regexp.Regexp = regexp.MustCompile(`(\w+)\s*=\s*("[^"]*"|\[[^\]]*\]|[^\s,}]+)`)
+var reLineRange *regexp.Regexp = regexp.MustCompile(`(\d+)(?:\s*-\s*(\d+))?`)
+
+func (site *Site) checkHighlightStyle() error {
+	if site.highlightStyle != "" && styles.Registry[site.highlightStyle] == nil {
+		return errors.New("Unknown highlight style: " + site.highlightStyle)
+	}
+	return nil
+}
+
+// highlightCode returns highlighted HTML for a fenced code block, or false if
+// highlighting is disabled or the language is unknown
+func (site *Site) highlightCode(info string, code []byte) ([]byte, bool) {
+	if site.highlightStyle == "" {
+		return nil, false
+	}
+
+	fields := strings.Fields(strings.Replace(info, "{", " {", 1))
+	if len(fields) == 0 {
+		return nil, false
+	}
+	lexer := lexers.Get(fields[0])
+	if lexer == nil {
+		return nil, false
+	}
+
+	options := []html.Option{
+		html.WithClasses(site.highlightClasses),
+		html.WithLineNumbers(site.lineNumbers),
+		html.TabWidth(4),
+	}
+
+	// hl_lines counts from the first line of the block, whatever linenostart is
+	start := 1
+	var lines [][2]int
+	for _, match := range reCodeAttribute.FindAllStringSubmatch(info, -1) {
+		value := strings.Trim(match[2], `"[]`)
+		switch match[1] {
+		case "linenos":
+			options = append(options, html.WithLineNumbers(value != "false"))
+		case "linenostart":
+			if n, err := strconv.Atoi(value); err == nil {
+				start = n
+			}
+		case "hl_lines":
+			lines = parseLineRanges(value)
+		}
+	}
+	for i := range lines {
+		lines[i][0] += start - 1
+		lines[i][1] += start - 1
+	}
+	options = append(options, html.BaseLineNumber(start), html.HighlightLines(lines))
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(code))
+	if err != nil {
+		return nil, false
+	}
+
+	var buffer bytes.Buffer
+	if err := html.New(options...).Format(&buffer, styles.Get(site.highlightStyle), iterator); err != nil {
+		return nil, false
+	}
+	return buffer.Bytes(), true
+}
+
+// parseLineRanges parses line ranges like "1 3-5" or "1, 3-5"
+func parseLineRanges(s string) [][2]int {
+	var ranges [][2]int
+	for _, match := range reLineRange.FindAllStringSubmatch(s, -1) {
+		start, _ := strconv.Atoi(match[1])
+		end := start
+		if match[2] != "" {
+			end, _ = strconv.Atoi(match[2])
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+// highlightCss returns the stylesheet needed with --highlight-classes
+func (site *Site) highlightCss() (string, error) {
+	if site.highlightStyle == "" {
+		return "", nil
+	}
+
+	var buffer bytes.Buffer
+	err := html.New(html.WithClasses(true)).WriteCSS(&buffer, styles.Get(site.highlightStyle))
+	return buffer.String(), err
+}
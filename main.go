@@ -2,9 +2,14 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/atmoz/ply/fileutil"
 	"github.com/docopt/docopt-go"
@@ -12,10 +17,18 @@ import (
 
 var site Site
 
+// tempTarget is the target made by "ply serve" without one, removed on exit
+var tempTarget string
+
 func main() {
 	usage := `ply - recursive markdown to HTML converter
 
+Options can also be set in .ply/config.yaml or ply.yaml, see README.md.
+Use --no-<option> to turn off an option turned on there, e.g. --no-sync.
+
 Usage:
+  ply serve [options] [<source-path>] [<target-path>]
+  ply check [options] [<source-path>] [<target-path>]
   ply [options] [<source-path>] [<target-path>]
   ply -h|--help
 
@@ -26,9 +39,46 @@ Options:
   --keep-links          Do NOT replace internal *.md links with *.html
   --ignore=<regex>      File names to ignore (defaults to "/\.")
   --allow-exec          Allow templates to execute commands (BE CAREFUL!)
+  --drafts              Include pages marked as draft
+  --future              Include pages with a publishDate in the future
+  --expired             Include pages with an expiryDate in the past
+  --highlight=<style>   Highlight fenced code blocks using a chroma style (e.g. "github")
+  --highlight-classes   Highlight with CSS classes, use {{ highlightCss }} for the stylesheet
+  --line-numbers        Show line numbers in highlighted code blocks
+  --heading-links       Add a self-link to every heading
+  --renderer=<name>     Markdown renderer, "blackfriday" or "commonmark" (defaults to "blackfriday")
+  --markdown=<options>  Comma separated markdown extensions and flags to enable,
+                        prefix with - to disable (e.g. "footnotes,-smartypants")
+  --template-markdown   Execute markdown as a template before it's rendered
+  --base-url=<url>      Url the site is published at, for sitemap.xml and robots.txt
+  --search              Write search.json, an index of all pages for searching the site
+  --search-fields=<fields>
+                        Comma separated fields of the search index
+                        (defaults to "title,url,tags,headings,body")
+  --redirects=<format>  Also list redirects for aliases in a file for the web server,
+                        "netlify" (_redirects) or "nginx" (redirects.map)
+  --paginate=<n>        Items per page for .Paginator (defaults to 10)
+  --jobs=<n>            Pages to render in parallel (defaults to number of CPUs)
+  --incremental         Only render pages affected by changes since last build
+  --sync                Remove files from target that were not part of this build
+  --dry-run             With --sync, only list the files that would be removed
+  --check-links         Report broken internal links after building, like "ply check"
+  --watch               Keep running and rebuild when source files change
+  --listen=<addr>       Address for "ply serve" to listen on [default: localhost:8080]
   `
 
-	args, _ := docopt.ParseDoc(usage)
+	// --no-<option> isn't known by docopt, see usage
+	var argv []string
+	site.disabled = make(map[string]bool)
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "--no-") {
+			site.disabled[strings.TrimPrefix(arg, "--no-")] = true
+		} else {
+			argv = append(argv, arg)
+		}
+	}
+
+	args, _ := docopt.ParseArgs(usage, argv, "")
 
 	site.SourcePath, _ = args.String("<source-path>")
 	site.TargetPath, _ = args.String("<target-path>")
@@ -37,6 +87,57 @@ Options:
 	site.prettyUrls, _ = args.Bool("--pretty-urls")
 	site.keepLinks, _ = args.Bool("--keep-links")
 	site.allowExec, _ = args.Bool("--allow-exec")
+	site.buildDrafts, _ = args.Bool("--drafts")
+	site.buildFuture, _ = args.Bool("--future")
+	site.buildExpired, _ = args.Bool("--expired")
+	site.highlightStyle, _ = args.String("--highlight")
+	site.highlightClasses, _ = args.Bool("--highlight-classes")
+	site.lineNumbers, _ = args.Bool("--line-numbers")
+	site.headingLinks, _ = args.Bool("--heading-links")
+	site.renderer, _ = args.String("--renderer")
+	if argMarkdown, _ := args.String("--markdown"); argMarkdown != "" {
+		site.markdown = strings.Split(argMarkdown, ",")
+	}
+	site.templateMarkdown, _ = args.Bool("--template-markdown")
+	site.redirects, _ = args.String("--redirects")
+	site.baseUrl, _ = args.String("--base-url")
+	site.search, _ = args.Bool("--search")
+	if argSearchFields, _ := args.String("--search-fields"); argSearchFields != "" {
+		site.searchFields = strings.Split(argSearchFields, ",")
+	}
+	site.incremental, _ = args.Bool("--incremental")
+	site.sync, _ = args.Bool("--sync")
+	site.dryRun, _ = args.Bool("--dry-run")
+
+	if argJobs, _ := args.String("--jobs"); argJobs != "" {
+		var err error
+		if site.jobs, err = strconv.Atoi(argJobs); err != nil {
+			fail(err)
+		}
+	}
+
+	if argPaginate, _ := args.String("--paginate"); argPaginate != "" {
+		var err error
+		if site.paginate, err = strconv.Atoi(argPaginate); err != nil {
+			fail(err)
+		}
+	}
+	watch, _ := args.Bool("--watch")
+	serve, _ := args.Bool("serve")
+	check, _ := args.Bool("check")
+	checkLinks, _ := args.Bool("--check-links")
+	site.checkLinks = check || checkLinks
+	listen, _ := args.String("--listen")
+
+	if serve && site.TargetPath == "" {
+		tempDir, err := ioutil.TempDir("", "ply")
+		if err != nil {
+			fail(err)
+		}
+		site.TargetPath = tempDir
+		tempTarget = tempDir
+		removeOnInterrupt(tempDir)
+	}
 
 	argIgnore, _ := args.String("--ignore")
 	if argIgnore != "" {
@@ -54,15 +155,49 @@ Options:
 	}
 
 	if err := site.Build(); err != nil {
-		fail(err)
+		if !watch && !serve {
+			fail(err)
+		}
+		fmt.Println("ERROR:", err)
+	} else {
+		fmt.Println(len(site.Pages), "pages")
+		PrintMemUsage()
+
+		broken, err := site.reportBrokenLinks()
+		if err != nil {
+			fail(err)
+		}
+		if broken > 0 && !watch && !serve {
+			fail(fmt.Errorf("%d broken links", broken))
+		}
 	}
 
-	fmt.Println(len(site.Pages), "pages")
-	PrintMemUsage()
+	if serve {
+		if err := site.Serve(listen); err != nil {
+			fail(err)
+		}
+	} else if watch {
+		if err := site.Watch(nil); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func removeOnInterrupt(path string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		os.RemoveAll(path)
+		os.Exit(0)
+	}()
 }
 
 func fail(err error) {
 	fmt.Println("FATAL:", err)
+	if tempTarget != "" {
+		os.RemoveAll(tempTarget)
+	}
 	os.Exit(1)
 }
 
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultRenderer string = "blackfriday"
+
+// Renderer converts markdown to HTML
+type Renderer interface {
+	// DefaultOptions returns all option names the renderer knows, and if
+	// they are enabled by default
+	DefaultOptions() map[string]bool
+
+	// Render returns the HTML and the headings of the content
+	Render(p *Page, content []byte, options map[string]bool) ([]byte, []Heading, error)
+}
+
+var markdownRenderers = map[string]Renderer{
+	"blackfriday": blackfridayRenderer{},
+	"commonmark":  commonmarkRenderer{},
+}
+
+// Heading is a heading of a rendered page, with the id used as anchor
+type Heading struct {
+	Level int
+	Text  string
+	Id    string
+}
+
+func getRenderer(name string) (Renderer, error) {
+	if name == "" {
+		name = defaultRenderer
+	}
+	if renderer := markdownRenderers[name]; renderer != nil {
+		return renderer, nil
+	}
+	return nil, errors.New("Unknown markdown renderer: " + name)
+}
+
+// applyMarkdownOptions enables the named options, or disables them when
+// prefixed with "-"
+func applyMarkdownOptions(options map[string]bool, names []string) error {
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		enable := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "-"), "+")
+
+		if _, ok := options[name]; ok {
+			options[name] = enable
+		} else if name != "" {
+			return errors.New("Unknown markdown option: " + name)
+		}
+	}
+	return nil
+}
+
+// checkMarkdown validates --renderer and --markdown
+func (site *Site) checkMarkdown() error {
+	renderer, err := getRenderer(site.renderer)
+	if err != nil {
+		return err
+	}
+	return applyMarkdownOptions(renderer.DefaultOptions(), site.markdown)
+}
+
+// markdownRenderer returns the renderer for the page, and its options from
+// --markdown and the "markdown" metadata, which is either a list or a comma
+// separated string. The "renderer" metadata overrides --renderer.
+func (p *Page) markdownRenderer() (Renderer, map[string]bool, error) {
+	configs := p.Site.dirConfigsOf(filepath.Dir(p.Path.AbsSrc))
+	name, _ := p.Meta["renderer"].(string)
+	for i := len(configs) - 1; name == "" && i >= 0; i-- {
+		name = configs[i].Renderer
+	}
+	if name == "" {
+		name = p.Site.renderer
+	}
+
+	renderer, err := getRenderer(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options := renderer.DefaultOptions()
+	if err := applyMarkdownOptions(options, p.Site.markdown); err != nil {
+		return nil, nil, err
+	}
+	for _, config := range configs {
+		if err := applyMarkdownOptions(options, config.Markdown); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch value := p.Meta["markdown"].(type) {
+	case nil:
+	case string:
+		err = applyMarkdownOptions(options, strings.Split(value, ","))
+	case []interface{}:
+		names := make([]string, len(value))
+		for i, name := range value {
+			names[i] = fmt.Sprint(name)
+		}
+		err = applyMarkdownOptions(options, names)
+	default:
+		err = errors.New("metadata \"markdown\" must be a list of option names")
+	}
+
+	return renderer, options, err
+}
+
+// renderMarkdown converts markdown to HTML, and returns the page headings
+func (p *Page) renderMarkdown(content []byte) ([]byte, []Heading, error) {
+	renderer, options, err := p.markdownRenderer()
+	if err != nil {
+		return nil, nil, err
+	}
+	return renderer.Render(p, content, options)
+}
+
+// Link attributes in raw HTML within markdown
+var reHtmlLink *regexp.Regexp = regexp.MustCompile(`(?i)(\b(?:href|src)=)("[^"]*"|'[^']*')`)
+
+// rewriteLink makes a link from the markdown source work from where the page
+// ends up. Links to .md files lead to the HTML page instead, unless
+// --keep-links is used, and relative links are adjusted for pages moved to
+// <name>/index.html by --pretty-urls. ref: links are resolved to the page.
+func (p *Page) rewriteLink(link string) (string, error) {
+	if strings.HasPrefix(link, refPrefix) {
+		atomic.StoreInt32(&p.refLinks, 1)
+		return p.Site.refLink(p.Path, link)
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.IsAbs() || u.Host != "" || u.Opaque != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return link, nil
+	}
+
+	srcDir := filepath.Dir(p.Path.AbsSrc)
+	target := filepath.Join(srcDir, filepath.FromSlash(u.Path))
+	if strings.HasSuffix(u.Path, ".md") && !p.Site.keepLinks {
+		u.Path = p.Path.UrlToAbs(p.Path.getTargetPath(target))
+		return u.String(), nil
+	} else if srcDir == p.Path.AbsDir {
+		return link, nil // Nothing moved
+	}
+
+	rel, err := filepath.Rel(p.Path.AbsDir, target)
+	if err != nil {
+		return link, nil
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasSuffix(u.Path, "/") && rel != "." {
+		rel += "/"
+	} else if rel == "." {
+		rel = "./"
+	}
+
+	u.Path = rel
+	return u.String(), nil
+}
+
+// rewriteHtmlLinks applies rewriteLink to href and src attributes
+func (p *Page) rewriteHtmlLinks(content []byte) (result []byte, err error) {
+	result = reHtmlLink.ReplaceAllFunc(content, func(attribute []byte) []byte {
+		m := reHtmlLink.FindSubmatch(attribute)
+		quote := string(m[2][:1])
+		link := html.UnescapeString(string(m[2][1 : len(m[2])-1]))
+		rewritten, rewriteErr := p.rewriteLink(link)
+		if rewriteErr != nil {
+			err = rewriteErr
+		}
+		if rewritten == link || rewriteErr != nil {
+			return attribute
+		}
+		return []byte(string(m[1]) + quote + htmlEscaper.Replace(rewritten) + quote)
+	})
+	return result, err
+}
+
+// headingIds hands out unique heading ids within a page
+type headingIds map[string]int
+
+// unique returns the custom id, or one made from the heading text, with a
+// number appended if it's already taken
+func (ids headingIds) unique(text, custom string) string {
+	id := custom
+	if id == "" {
+		if id = slugify(text); id == "" {
+			id = "section"
+		}
+	}
+
+	if n := ids[id]; n > 0 {
+		ids[id]++
+		id += "-" + strconv.Itoa(n)
+	}
+	ids[id]++
+	return id
+}
+
+// tableOfContents renders headings as nested lists
+func tableOfContents(headings []Heading) string {
+	if len(headings) == 0 {
+		return ""
+	}
+
+	var toc strings.Builder
+	toc.WriteString("<nav class=\"toc\">\n")
+	var levels []int // Levels of the open lists
+	for _, h := range headings {
+		if len(levels) == 0 || h.Level > levels[len(levels)-1] {
+			if len(levels) > 0 {
+				toc.WriteString("\n")
+			}
+			toc.WriteString("<ul>\n")
+			levels = append(levels, h.Level)
+		} else {
+			toc.WriteString("</li>\n")
+			for len(levels) > 1 && h.Level < levels[len(levels)-1] {
+				toc.WriteString("</ul>\n</li>\n")
+				levels = levels[:len(levels)-1]
+			}
+		}
+		fmt.Fprintf(&toc, `<li><a href="#%s">%s</a>`, h.Id, html.EscapeString(h.Text))
+	}
+	for range levels {
+		toc.WriteString("</li>\n</ul>\n")
+	}
+	toc.WriteString("</nav>\n")
+
+	return toc.String()
+}
@@ -4,18 +4,17 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
-	"net/url"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	blackfriday "gopkg.in/russross/blackfriday.v2"
 	yaml "gopkg.in/yaml.v2"
 )
 
-var reMarkdownHref *regexp.Regexp = regexp.MustCompile(`(<a[^>]*href=")([^"]+\.md)("[^>]*>)`)
-
 type PageMeta map[string]interface{}
 
 type Page struct {
@@ -27,7 +26,67 @@ type Page struct {
 	Data  interface{}
 	tags  []string
 
-	content []byte
+	Draft       bool
+	PublishDate time.Time
+	ExpiryDate  time.Time
+
+	body           *PlyTemplate // Generates content for pages without markdown
+	content        []byte
+	headings       []Heading
+	headingsDone   bool
+	contentLock    sync.Mutex   // Guards the fields above, not the rendering
+	contentRenders int          // Renders of the content in progress
+	contentCycle   bool         // Set when the content depends on itself
+	contentDeps    pageDeps     // Recorded by shortcodes, while rendering content
+	contentLog     bytes.Buffer // Logged by shortcodes, while rendering content
+	refLinks       int32        // Set when the content has ref: links
+	deps           *pageDeps
+	log            bytes.Buffer
+}
+
+// pageRender is what templates see while a page is rendered: the page itself,
+// but with the content produced by the previous template in the chain. Pages
+// split by pagination are rendered once per page number, each with its own path.
+type pageRender struct {
+	*Page
+	Path *Path
+
+	content   []byte
+	inBody    bool // The body of a generated page is being executed
+	number    int
+	paginator *Paginator
+}
+
+func newPageRender(p *Page, path *Path, number int, content []byte) *pageRender {
+	return &pageRender{Page: p, Path: path, number: number, content: content}
+}
+
+func (r *pageRender) Content() (string, error) {
+	content, err := r.ContentBytes()
+	return string(content), err
+}
+
+func (r *pageRender) ContentBytes() ([]byte, error) {
+	if r.inBody {
+		return nil, r.bodyContentError()
+	}
+	return r.content, nil
+}
+
+func (r *pageRender) Url() string {
+	return r.Path.Url()
+}
+
+func (r *pageRender) UrlDirParts() map[string]string {
+	return r.Path.UrlDirParts()
+}
+
+func (r *pageRender) UrlRelTo(relPath string) (string, error) {
+	return r.Path.UrlRelTo(relPath)
+}
+
+func (r *pageRender) UrlToRoot() string {
+	return r.Path.UrlToRoot()
 }
 
 func NewPage(site *Site, absSrcPath string) (p *Page, err error) {
@@ -39,29 +98,88 @@ func NewPage(site *Site, absSrcPath string) (p *Page, err error) {
 
 	content, err := ioutil.ReadFile(p.Path.AbsSrc)
 	if err != nil {
-		panic(err)
+		return nil, errors.New(p.Path.Rel + ": " + err.Error())
 	}
 
 	p.Meta, content, err = splitMetaAndContent(content)
 	if err != nil {
-		panic(err)
+		return nil, errors.New(p.Path.Rel + ": " + err.Error())
 	}
 
-	if p.Meta["title"] != nil {
-		p.Title = p.Meta["title"].(string)
+	if title, ok := p.Meta["title"].(string); ok {
+		p.Title = title
+	} else if p.Meta["title"] != nil {
+		return nil, errors.New(p.Path.Rel + ": metadata \"title\" must be a string")
 	} else if h := findFirstHeading(content); h != "" {
 		p.Title = h
 	} else {
 		p.Title = p.Name
 	}
 
-	if err := p.registerTags(); err != nil {
+	if draft, ok := p.Meta["draft"].(bool); ok {
+		p.Draft = draft
+	} else if p.Meta["draft"] != nil {
+		return nil, errors.New(p.Path.Rel + ": metadata \"draft\" must be true or false")
+	}
+
+	if p.PublishDate, err = p.metaTime("publishDate"); err != nil {
+		return nil, err
+	}
+	if p.ExpiryDate, err = p.metaTime("expiryDate"); err != nil {
 		return nil, err
 	}
 
+	if p.IsPublished() {
+		if err := p.registerTaxonomies(); err != nil {
+			return nil, err
+		}
+	}
+
 	return p, nil
 }
 
+// IsPublished tells if the page is part of the site, based on the draft,
+// publishDate and expiryDate metadata
+func (p *Page) IsPublished() bool {
+	now := time.Now()
+	if p.Draft && !p.Site.buildDrafts {
+		return false
+	}
+	if !p.PublishDate.IsZero() && p.PublishDate.After(now) && !p.Site.buildFuture {
+		return false
+	}
+	if !p.ExpiryDate.IsZero() && !p.ExpiryDate.After(now) && !p.Site.buildExpired {
+		return false
+	}
+	return true
+}
+
+var metaTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// metaTime parses a date from metadata, times without zone are local
+func (p *Page) metaTime(key string) (time.Time, error) {
+	switch value := p.Meta[key].(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return value, nil
+	case string:
+		for _, layout := range metaTimeLayouts {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return t, nil
+			}
+		}
+	}
+
+	return time.Time{}, errors.New(p.Path.Rel + ": metadata \"" + key + "\" is not a valid date")
+}
+
 func (p *Page) init(site *Site, absSrcPath string) (err error) {
 	if !filepath.IsAbs(absSrcPath) {
 		return errors.New(absSrcPath + " must be an absolute path!")
@@ -103,12 +221,61 @@ func (p *Page) Content() (content string, err error) {
 	return string(bytes), nil
 }
 
-func (p *Page) ContentBytes() (content []byte, err error) {
+// ContentBytes returns the rendered markdown content of the page.
+//
+// Content is rendered without holding a lock, as shortcodes and templated
+// markdown may read the content of other pages, which may be reading this
+// one on another render job. The same content may then be rendered more than
+// once at a time, and the first result is kept. There can't be more renders
+// in progress than render jobs, unless the content depends on itself.
+func (p *Page) ContentBytes() ([]byte, error) {
+	if p.body != nil {
+		return nil, p.bodyContentError()
+	}
+
+	p.contentLock.Lock()
 	if p.content != nil {
+		defer p.contentLock.Unlock()
 		return p.content, nil
+	} else if p.contentRenders > p.Site.renderJobs() {
+		p.contentCycle = true
+		p.contentLock.Unlock()
+		return nil, p.contentCycleError()
+	}
+	p.contentRenders++
+	p.contentLock.Unlock()
+
+	var deps pageDeps
+	var log bytes.Buffer
+	content, err := p.renderContent(&deps, &log)
+
+	p.contentLock.Lock()
+	defer p.contentLock.Unlock()
+	p.contentRenders--
+	if err != nil && p.contentCycle {
+		return nil, p.contentCycleError() // Instead of one error per render
+	} else if err != nil {
+		return nil, err
+	} else if p.content == nil {
+		p.content = content
+		p.contentDeps = deps
+		p.contentLog.Write(log.Bytes())
 	}
+	return p.content, nil
+}
+
+// bodyContentError is returned when reading the content of a generated page,
+// which is only known once its template is executed
+func (p *Page) bodyContentError() error {
+	return errors.New("content of " + p.Path.Rel + " isn't known while " + filepath.Base(p.body.path) + " is executed")
+}
 
-	content, err = ioutil.ReadFile(p.Path.AbsSrc)
+func (p *Page) contentCycleError() error {
+	return errors.New("content of " + p.Path.Rel + " depends on itself")
+}
+
+func (p *Page) renderContent(deps *pageDeps, log *bytes.Buffer) ([]byte, error) {
+	content, err := ioutil.ReadFile(p.Path.AbsSrc)
 	if err != nil {
 		return nil, err
 	}
@@ -118,50 +285,170 @@ func (p *Page) ContentBytes() (content []byte, err error) {
 		return nil, err
 	}
 
-	content = blackfriday.Run(content)
+	content, shortcodes, err := extractShortcodes(content)
+	if err != nil {
+		return nil, err
+	}
 
-	// Replace internal .md links
-	if !p.Site.keepLinks {
-		for _, match := range reMarkdownHref.FindAllSubmatch(content, -1) {
-			href := string(match[2])
+	if p.isTemplated() {
+		if content, err = p.executeContent(content, deps, log); err != nil {
+			return nil, err
+		}
+	}
 
-			hrefUrl, err := url.Parse(href)
-			if err != nil {
-				continue // Ignore, this may not be a normal URL
-			}
+	content, headings, err := p.renderMarkdown(content)
+	if err != nil {
+		return nil, err
+	}
 
-			if hrefUrl.IsAbs() {
-				continue // Ignore, do not touch absolute URL
-			}
+	// Shortcodes can use the headings
+	p.contentLock.Lock()
+	if !p.headingsDone {
+		p.headings, p.headingsDone = headings, true
+	}
+	p.contentLock.Unlock()
 
-			before := string(match[1])
-			href = strings.TrimSuffix(href, ".md")
-			if !p.Site.prettyUrls {
-				href += ".html"
-			}
-			after := string(match[3])
-			content = bytes.Replace(content, match[0], []byte(before+href+after), -1)
+	outputs, err := p.executeShortcodes(shortcodes, deps, log)
+	if err != nil {
+		return nil, err
+	}
+	// Links in shortcode output are rewritten like those in the markdown
+	for i, output := range outputs {
+		if outputs[i], err = p.rewriteHtmlLinks(output); err != nil {
+			return nil, err
 		}
 	}
 
-	return content, nil
+	if atomic.LoadInt32(&p.refLinks) != 0 {
+		deps.Site = true // The pages referred to may move
+	}
+	return replaceShortcodes(content, outputs), nil
 }
 
-func (p *Page) parse() (result []byte, err error) {
-	p.content, err = p.ContentBytes()
+// isTemplated tells if the markdown is executed as a template before it's
+// rendered, with --template-markdown, ply.yaml or the "template" metadata
+func (p *Page) isTemplated() bool {
+	if templated, ok := p.Meta["template"].(bool); ok {
+		return templated
+	}
+	configs := p.Site.dirConfigsOf(filepath.Dir(p.Path.AbsSrc))
+	for i := len(configs) - 1; i >= 0; i-- {
+		if configs[i].TemplateMarkdown != nil {
+			return *configs[i].TemplateMarkdown
+		}
+	}
+	return p.Site.templateMarkdown
+}
+
+// executeContent executes markdown as a template, with the page as data
+func (p *Page) executeContent(content []byte, deps *pageDeps, log *bytes.Buffer) ([]byte, error) {
+	t, err := parsePlyTemplate(p.Site, p.Path.AbsSrc, content)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.usesSite {
+		deps.Site = true
+	}
+	if t, err = t.bind(p.Path, deps, log); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err := t.template.Execute(&buffer, p); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Headings returns all headings of the page content, in order
+func (p *Page) Headings() ([]Heading, error) {
+	p.contentLock.Lock()
+	headings, done := p.headings, p.headingsDone
+	p.contentLock.Unlock()
+	if done {
+		return headings, nil
+	}
+
+	if _, err := p.ContentBytes(); err != nil {
+		return nil, err
+	}
+	p.contentLock.Lock()
+	defer p.contentLock.Unlock()
+	return p.headings, nil
+}
+
+// TableOfContents returns the page headings as nested HTML lists
+func (p *Page) TableOfContents() (string, error) {
+	headings, err := p.Headings()
 	if err != nil {
+		return "", err
+	}
+	return tableOfContents(headings), nil
+}
+
+func (p *Page) parse() (result []byte, err error) {
+	p.deps = new(pageDeps)
+	p.deps.addFile(p.Path.AbsSrc)
+	p.deps.addOutput(p.Path.Abs)
+	p.log.Reset()
+
+	var content []byte
+	if p.body == nil {
+		if content, err = p.ContentBytes(); err != nil {
+			return nil, err
+		}
+		p.deps.merge(&p.contentDeps)
+		p.log.Write(p.contentLog.Bytes())
+	}
+
+	render := newPageRender(p, p.Path, 1, content)
+	if result, err = render.execute(); err != nil {
 		return nil, err
 	}
 
-	// Apply templates recursively
+	if render.paginator != nil {
+		for number := 2; number <= render.paginator.TotalPages; number++ {
+			if err := p.writePaginated(number, content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// execute generates the content of generated pages, and applies templates
+// recursively from the page directory up to the root
+func (r *pageRender) execute() ([]byte, error) {
+	p := r.Page
+	if p.body != nil {
+		p.deps.addFile(p.body.path)
+		p.deps.Site = true // Generated pages are listings of other pages
+
+		r.inBody = true
+		content, err := r.executeTemplate(p.body)
+		r.inBody = false
+		if err != nil {
+			return nil, err
+		}
+		r.content = content
+	}
+
 	dirname := p.Path.AbsDir
 	for {
-		if p.Site.templates[dirname] != nil {
-			var templateBuffer bytes.Buffer
-			if err := p.Site.templates[dirname].template.Execute(&templateBuffer, p); err != nil {
+		// Depend on missing templates too, so adding one is noticed
+		p.deps.addFile(filepath.Join(dirname, "ply.template"))
+		if t := p.Site.template(dirname); t != nil {
+			if t.usesSite {
+				p.deps.Site = true
+			}
+
+			content, err := r.executeTemplate(t)
+			if err != nil {
 				return nil, err
 			}
-			p.content = templateBuffer.Bytes() // Update content from template
+			r.content = content // Update content from template
 		}
 
 		// Break loop when we are on root (last) level
@@ -174,28 +461,50 @@ func (p *Page) parse() (result []byte, err error) {
 		dirname = filepath.Dir(dirname) // Remove last dir
 	}
 
-	result = p.content
-	p.content = nil // This was only needed for templating
-	return result, nil
+	return r.content, nil
 }
 
-func (p *Page) registerTags() error {
-	if p.Meta["tags"] == nil {
-		return nil
+func (r *pageRender) executeTemplate(t *PlyTemplate) ([]byte, error) {
+	t, err := t.forPage(r)
+	if err != nil {
+		return nil, err
 	}
 
-	if t := reflect.TypeOf(p.Meta["tags"]).String(); t != "[]interface {}" {
-		return errors.New(p.Path.Rel + ": metadata \"tags\" must be of type []string, but was " + t)
+	var buffer bytes.Buffer
+	if err := t.template.Execute(&buffer, r); err != nil {
+		return nil, err
 	}
+	return buffer.Bytes(), nil
+}
 
-	tags := p.Meta["tags"].([]interface{})
-	for _, tag := range tags {
-		if t := reflect.TypeOf(tag).String(); t != "string" {
-			return errors.New(p.Path.Rel + ": tag must be of type string, but was " + t)
+// registerTaxonomies adds the page to the terms listed in its metadata, e.g.
+// "tags: [go, web]". A single term can also be given as a plain string.
+func (p *Page) registerTaxonomies() error {
+	for taxonomy := range p.Site.taxonomies {
+		var terms []interface{}
+		switch value := p.Meta[taxonomy].(type) {
+		case nil:
+			continue
+		case string:
+			terms = []interface{}{value}
+		case []interface{}:
+			terms = value
+		default:
+			t := reflect.TypeOf(value).String()
+			return errors.New(p.Path.Rel + ": metadata \"" + taxonomy + "\" must be of type []string, but was " + t)
+		}
+
+		for _, term := range terms {
+			name, ok := term.(string)
+			if !ok {
+				t := reflect.TypeOf(term).String()
+				return errors.New(p.Path.Rel + ": " + taxonomy + " must be of type string, but was " + t)
+			}
+			if taxonomy == "tags" {
+				p.tags = append(p.tags, name)
+			}
+			p.Site.addTerm(taxonomy, name, p)
 		}
-		name := tag.(string)
-		p.tags = append(p.tags, name)
-		site.Tags[name] = append(site.Tags[name], p)
 	}
 
 	return nil
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultPaginate int = 10
+
+// Paginator is one chunk of a paginated page list, with relative urls to the
+// other pages of the listing
+type Paginator struct {
+	PageNumber int
+	TotalPages int
+	Items      []*Page
+
+	HasPrev  bool
+	HasNext  bool
+	FirstUrl string
+	LastUrl  string
+	PrevUrl  string
+	NextUrl  string
+}
+
+// Paginate splits pages into chunks of "paginate" (from metadata or
+// --paginate) items, and returns the chunk of the page being rendered. Only
+// the first list given is used. Page 1 is the page itself, the others are
+// written to <page>/page/<n>/index.html.
+func (r *pageRender) Paginate(pages []*Page) (*Paginator, error) {
+	if r.paginator != nil {
+		return r.paginator, nil
+	}
+
+	size, err := r.pageSize()
+	if err != nil {
+		return nil, err
+	}
+
+	total := (len(pages) + size - 1) / size
+	if total == 0 {
+		total = 1
+	}
+
+	start := (r.number - 1) * size
+	end := start + size
+	if start > len(pages) {
+		start = len(pages)
+	}
+	if end > len(pages) {
+		end = len(pages)
+	}
+
+	pager := &Paginator{
+		PageNumber: r.number,
+		TotalPages: total,
+		Items:      pages[start:end],
+		HasPrev:    r.number > 1,
+		HasNext:    r.number < total,
+		FirstUrl:   r.pageUrl(1),
+		LastUrl:    r.pageUrl(total),
+	}
+	if pager.HasPrev {
+		pager.PrevUrl = r.pageUrl(r.number - 1)
+	}
+	if pager.HasNext {
+		pager.NextUrl = r.pageUrl(r.number + 1)
+	}
+
+	r.deps.Site = true
+	r.paginator = pager
+	return pager, nil
+}
+
+// Paginator paginates the sitemap, use Paginate for any other list
+func (r *pageRender) Paginator() (*Paginator, error) {
+	return r.Paginate(r.Sitemap())
+}
+
+func (r *pageRender) pageSize() (int, error) {
+	switch size := r.Meta["paginate"].(type) {
+	case nil:
+		if r.Site.paginate > 0 {
+			return r.Site.paginate, nil
+		}
+		return defaultPaginate, nil
+	case int:
+		if size > 0 {
+			return size, nil
+		}
+	}
+
+	return 0, errors.New(r.Page.Path.Rel + ": metadata \"paginate\" must be a positive number")
+}
+
+func (r *pageRender) pageUrl(number int) string {
+	return r.Path.UrlToAbs(r.paginatedPath(number))
+}
+
+// paginatedPath returns where page number n of a paginated page is written
+func (p *Page) paginatedPath(number int) string {
+	if number == 1 {
+		return p.Path.Abs
+	}
+
+	base := strings.TrimSuffix(p.Path.Abs, filepath.Ext(p.Path.Abs))
+	if filepath.Base(p.Path.Abs) == "index.html" {
+		base = p.Path.AbsDir
+	}
+	return filepath.Join(base, "page", strconv.Itoa(number), "index.html")
+}
+
+func (p *Page) writePaginated(number int, content []byte) error {
+	absPath := p.paginatedPath(number)
+	path, err := NewPath(p.Site, filepath.Join(filepath.Dir(absPath), "index.md"))
+	if err != nil {
+		return err
+	}
+
+	result, err := newPageRender(p, path, number, content).execute()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.AbsDir, defaultDirMode); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(absPath, result, defaultFileMode); err != nil {
+		return err
+	}
+
+	p.deps.addOutput(absPath)
+	fmt.Fprintln(&p.log, "Page:", absPath)
+	return nil
+}
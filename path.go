@@ -3,9 +3,12 @@ package main
 import (
 	"errors"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+var reSlugSeparators *regexp.Regexp = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
 type Path struct {
 	site      *Site
 	Rel       string
@@ -96,6 +99,28 @@ func (p *Path) UrlRelTo(to string) (string, error) {
 	return normalizePathToUrl(path), nil
 }
 
+// UrlToAbs returns a relative url from this path to a file in the target. With
+// pretty urls, links to index.html point to the directory instead.
+func (p *Path) UrlToAbs(absPath string) string {
+	rel, err := filepath.Rel(p.AbsDir, absPath)
+	if err != nil {
+		return ""
+	}
+
+	return p.site.prettyUrl(normalizePathToUrl(rel))
+}
+
+// prettyUrl leaves out index.html with --pretty-urls
+func (site *Site) prettyUrl(url string) string {
+	if site.prettyUrls && (url == "index.html" || strings.HasSuffix(url, "/index.html")) {
+		url = strings.TrimSuffix(url, "index.html")
+		if url == "" {
+			url = "./"
+		}
+	}
+	return url
+}
+
 func (p *Path) UrlToRoot() string {
 	return normalizePathToUrl(p.RelToRoot)
 }
@@ -107,3 +132,8 @@ func normalizePathToUrl(path string) string {
 		return path
 	}
 }
+
+// slugify turns a name into something safe to use in a path, "Go Tips!" -> "go-tips"
+func slugify(name string) string {
+	return strings.Trim(reSlugSeparators.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	urlpath "path"
+	"path/filepath"
+	"strings"
+)
+
+// Files listing all redirects for the web server, by --redirects format
+var redirectFiles = map[string]string{
+	"netlify": "_redirects",
+	"nginx":   "redirects.map",
+}
+
+var redirectTemplate *template.Template = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{ .Title }}</title>
+<link rel="canonical" href="{{ .Canonical }}">
+<meta http-equiv="refresh" content="0; url={{ .Url }}">
+</head>
+<body>
+<a href="{{ .Url }}">{{ .Title }}</a>
+</body>
+</html>
+`))
+
+type redirect struct {
+	From string // Url path of the alias, from the site root
+	To   string // Url path of the page, from the site root
+}
+
+func (site *Site) checkRedirects() error {
+	if _, ok := redirectFiles[site.redirects]; site.redirects != "" && !ok {
+		return errors.New("Unknown redirects format: " + site.redirects)
+	}
+	return nil
+}
+
+// writeRedirects writes a page redirecting to the page for every alias in
+// the "aliases" metadata, and with --redirects a file listing them all
+func (site *Site) writeRedirects() error {
+	var redirects []redirect
+	for _, p := range site.Pages {
+		aliases, err := p.aliases()
+		if err != nil {
+			return err
+		}
+
+		for _, alias := range aliases {
+			from := urlpath.Clean("/" + alias)
+			absPath := filepath.Join(site.TargetPath, filepath.FromSlash(from))
+			if strings.HasSuffix(alias, "/") || urlpath.Ext(from) == "" {
+				absPath = filepath.Join(absPath, "index.html")
+				from = strings.TrimSuffix(from, "/") + "/"
+			}
+
+			site.lock.RLock()
+			taken := site.written[absPath]
+			site.lock.RUnlock()
+			if taken {
+				return errors.New(p.Path.Rel + ": alias \"" + alias + "\" would overwrite " + absPath)
+			}
+
+			url, err := filepath.Rel(filepath.Dir(absPath), p.Path.Abs)
+			if err != nil {
+				return err
+			}
+			url = site.prettyUrl(normalizePathToUrl(url))
+			canonical := url
+			if site.baseUrl != "" {
+				canonical = site.AbsUrl(p)
+			}
+
+			var buffer bytes.Buffer
+			data := map[string]string{"Title": p.Title, "Url": url, "Canonical": canonical}
+			if err := redirectTemplate.Execute(&buffer, data); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(absPath), defaultDirMode); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(absPath, buffer.Bytes(), defaultFileMode); err != nil {
+				return err
+			}
+			fmt.Println("Redirect:", absPath)
+			site.markWritten(absPath)
+
+			redirects = append(redirects, redirect{from, site.prettyUrl("/" + p.Path.Url())})
+		}
+	}
+
+	if site.redirects == "" {
+		return nil
+	}
+	return site.writeRedirectFile(redirects)
+}
+
+func (site *Site) writeRedirectFile(redirects []redirect) error {
+	var buffer bytes.Buffer
+	for _, r := range redirects {
+		switch site.redirects {
+		case "netlify":
+			fmt.Fprintf(&buffer, "%s %s 301\n", r.From, r.To)
+		case "nginx":
+			fmt.Fprintf(&buffer, "%s %s;\n", r.From, r.To)
+		}
+	}
+
+	absPath := filepath.Join(site.TargetPath, redirectFiles[site.redirects])
+	site.markWritten(absPath)
+	return ioutil.WriteFile(absPath, buffer.Bytes(), defaultFileMode)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// refPrefix marks links to pages by identifier, e.g. [install](ref:install-guide)
+const refPrefix string = "ref:"
+
+// indexRefs collects the identifiers pages can be referred to by: the "id"
+// and "aliases" metadata, and the source path with or without .md
+func (site *Site) indexRefs() error {
+	site.refs = make(map[string]*Page)
+	for _, p := range site.Pages {
+		names, err := p.refNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if other := site.refs[name]; other != nil && other != p {
+				return errors.New(p.Path.Rel + ": ref \"" + name + "\" is already used by " + other.Path.Rel)
+			}
+			site.refs[name] = p
+		}
+	}
+
+	// Paths are only used when no page has them as identifier
+	for _, p := range site.Pages {
+		rel, err := filepath.Rel(site.TargetPath, p.Path.AbsSrc)
+		if err != nil {
+			return err
+		}
+		rel = normalizePathToUrl(rel)
+		for _, name := range []string{rel, strings.TrimSuffix(rel, ".md")} {
+			if site.refs[name] == nil {
+				site.refs[name] = p
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Page) refNames() (names []string, err error) {
+	switch id := p.Meta["id"].(type) {
+	case nil:
+	case string:
+		names = append(names, normalizeRef(id))
+	default:
+		return nil, errors.New(p.Path.Rel + ": metadata \"id\" must be a string")
+	}
+
+	aliases, err := p.aliases()
+	for _, alias := range aliases {
+		names = append(names, normalizeRef(alias))
+	}
+	return names, err
+}
+
+// aliases returns the "aliases" metadata, other paths the page is known by
+func (p *Page) aliases() (aliases []string, err error) {
+	switch value := p.Meta["aliases"].(type) {
+	case nil:
+	case string:
+		aliases = append(aliases, value)
+	case []interface{}:
+		for _, alias := range value {
+			name, ok := alias.(string)
+			if !ok {
+				t := reflect.TypeOf(alias).String()
+				return nil, errors.New(p.Path.Rel + ": aliases must be of type string, but was " + t)
+			}
+			aliases = append(aliases, name)
+		}
+	default:
+		t := reflect.TypeOf(value).String()
+		return nil, errors.New(p.Path.Rel + ": metadata \"aliases\" must be of type []string, but was " + t)
+	}
+	return aliases, nil
+}
+
+func normalizeRef(name string) string {
+	return strings.Trim(strings.TrimSpace(name), "/")
+}
+
+// ref finds the page with an identifier
+func (site *Site) ref(name string) (*Page, error) {
+	if p := site.refs[normalizeRef(name)]; p != nil {
+		return p, nil
+	}
+	return nil, errors.New("unknown ref \"" + name + "\"")
+}
+
+// refLink resolves a ref: link, with an optional #anchor or query, to a
+// relative url from path
+func (site *Site) refLink(from *Path, link string) (string, error) {
+	name := strings.TrimPrefix(link, refPrefix)
+	suffix := ""
+	if i := strings.IndexAny(name, "#?"); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+
+	p, err := site.ref(name)
+	if err != nil {
+		return "", err
+	}
+	return from.UrlToAbs(p.Path.Abs) + suffix, nil
+}
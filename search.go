@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+)
+
+const searchIndexFile string = "search.json"
+
+// Fields of the pages in the search index, all of them by default
+var searchFields = []string{"title", "url", "tags", "headings", "body"}
+
+var reHtmlTag *regexp.Regexp = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+var reHtmlBlockTag *regexp.Regexp = regexp.MustCompile(`(?i)</?(p|h[1-6]|ul|ol|li|dl|dt|dd|div|pre|blockquote|table|tr|th|td|br|hr|figure|figcaption)\b[^>]*>`)
+var reHtmlNoText *regexp.Regexp = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>|<a class="anchor"[^>]*>#</a>`)
+var reSpaces *regexp.Regexp = regexp.MustCompile(`\s+`)
+
+// searchShortcode is the "search" shortcode, unless .ply/shortcodes has one:
+// a search box and results, looked up in search.json without dependencies
+const searchShortcode string = `<form class="search" onsubmit="return false">
+<input type="search" placeholder="Search" aria-label="Search" autocomplete="off">
+</form>
+<ul class="search-results"></ul>
+<script>
+(function () {
+  var script = document.currentScript;
+  var input = script.previousElementSibling.previousElementSibling.querySelector("input");
+  var results = script.previousElementSibling;
+  var indexUrl = new URL("{{ searchIndexUrl }}", document.baseURI);
+  var index = fetch(indexUrl).then(function (r) { return r.json(); });
+
+  function text(page) {
+    return [page.title, (page.headings || []).join(" "), (page.tags || []).join(" "), page.body].join(" ").toLowerCase();
+  }
+
+  function search() {
+    var words = input.value.toLowerCase().split(/\s+/).filter(Boolean);
+    index.then(function (pages) {
+      results.textContent = "";
+      if (words.length == 0) return;
+      pages.filter(function (page) {
+        var t = text(page);
+        return words.every(function (w) { return t.indexOf(w) >= 0; });
+      }).forEach(function (page) {
+        var li = document.createElement("li");
+        var a = document.createElement("a");
+        a.href = new URL(page.url || "", indexUrl);
+        a.textContent = page.title || page.url;
+        li.appendChild(a);
+        results.appendChild(li);
+      });
+    });
+  }
+
+  input.addEventListener("input", search);
+  input.value = new URLSearchParams(location.search).get("q") || "";
+  search();
+})();
+</script>
+`
+
+func (site *Site) checkSearch() error {
+	for _, field := range site.searchFields {
+		if !hasString(searchFields, field) {
+			return errors.New("Unknown search field: " + field)
+		}
+	}
+	return nil
+}
+
+// writeSearchIndex writes search.json with --search, listing the fields of
+// every page without "search: false" in its metadata
+func (site *Site) writeSearchIndex() error {
+	if !site.search {
+		return nil
+	}
+
+	fields := site.searchFields
+	if len(fields) == 0 {
+		fields = searchFields
+	}
+
+	index := []map[string]interface{}{}
+	for _, p := range site.Pages {
+		if include, ok := p.Meta["search"].(bool); ok && !include {
+			continue
+		}
+
+		entry := make(map[string]interface{})
+		for _, field := range fields {
+			switch field {
+			case "title":
+				entry["title"] = p.Title
+			case "url":
+				entry["url"] = site.rootUrlOf(p.Path.Abs)
+			case "tags":
+				entry["tags"] = append([]string{}, p.tags...)
+			case "headings":
+				headings, err := p.Headings()
+				if err != nil {
+					return err
+				}
+				texts := []string{}
+				for _, h := range headings {
+					texts = append(texts, h.Text)
+				}
+				entry["headings"] = texts
+			case "body":
+				content, err := p.ContentBytes()
+				if err != nil {
+					return err
+				}
+				entry["body"] = plainText(content)
+			}
+		}
+		index = append(index, entry)
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(index); err != nil {
+		return err
+	}
+	return site.writeGenerated(searchIndexFile, buffer.Bytes())
+}
+
+// plainText strips the tags of HTML content, leaving the text
+func plainText(content []byte) string {
+	content = reHtmlNoText.ReplaceAll(content, []byte(" "))
+	content = reHtmlBlockTag.ReplaceAll(content, []byte(" "))
+	content = reHtmlTag.ReplaceAll(content, nil)
+	text := html.UnescapeString(string(content))
+	return strings.TrimSpace(reSpaces.ReplaceAllString(text, " "))
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const reloadUrl string = "/_ply/reload"
+
+const reloadScript string = `<script>
+new EventSource("` + reloadUrl + `").onmessage = function() { location.reload(); };
+</script>
+`
+
+// Serve builds the site, serves the target directory over HTTP and tells
+// open browsers to reload after every rebuild triggered by source changes.
+func (site *Site) Serve(addr string) error {
+	reloader := newReloader()
+
+	mux := http.NewServeMux()
+	mux.Handle(reloadUrl, reloader)
+	mux.HandleFunc("/", site.serveFile)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- http.ListenAndServe(addr, mux)
+	}()
+	go func() {
+		errc <- site.Watch(reloader.Reload)
+	}()
+
+	fmt.Println("Serving", site.TargetPath, "on http://"+addr+"/")
+	return <-errc
+}
+
+func (site *Site) serveFile(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	absPath := filepath.Join(site.TargetPath, filepath.FromSlash(urlPath))
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if info.IsDir() {
+		// Same layout as --pretty-urls produces: foo/ is served from foo/index.html
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		absPath = filepath.Join(absPath, "index.html")
+		if info, err = os.Stat(absPath); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if filepath.Ext(absPath) != ".html" {
+		http.ServeFile(w, r, absPath)
+		return
+	}
+
+	content, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if i := bytes.LastIndex(content, []byte("</body>")); i >= 0 {
+		content = append(content[:i], append([]byte(reloadScript), content[i:]...)...)
+	} else {
+		content = append(content, reloadScript...)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(content)
+}
+
+// reloader keeps track of connected browsers and pushes server-sent events
+type reloader struct {
+	sync.Mutex
+	clients map[chan bool]bool
+}
+
+func newReloader() *reloader {
+	return &reloader{clients: make(map[chan bool]bool)}
+}
+
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	client := make(chan bool, 1)
+	rl.Lock()
+	rl.clients[client] = true
+	rl.Unlock()
+
+	defer func() {
+		rl.Lock()
+		delete(rl.clients, client)
+		rl.Unlock()
+	}()
+
+	for {
+		select {
+		case <-client:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (rl *reloader) Reload() {
+	rl.Lock()
+	defer rl.Unlock()
+
+	for client := range rl.clients {
+		select {
+		case client <- true:
+		default: // A reload is already pending
+		}
+	}
+}
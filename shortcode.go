@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// shortcodesDir in .ply holds a template per shortcode, named after the
+// shortcode, e.g. figure.html for {{< figure src="x.png" >}}
+const shortcodesDir string = "shortcodes"
+
+// Shortcode tags: {{< name args >}}, {{< name args />}} and {{< /name >}}.
+// {{</* name */>}} is written as {{< name >}} without being executed.
+var reShortcode *regexp.Regexp = regexp.MustCompile(`\{\{<\s*(/\*.*?\*/|(/)?\s*([\w-]+)((?:\s+(?:[\w-]+=(?:"(?:[^"\\]|\\.)*"|[^\s">]+)|"(?:[^"\\]|\\.)*"|[^\s">/][^\s">]*))*)\s*(/)?)\s*>\}\}`)
+
+// Escapes like the markdown renderers do
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+var reShortcodeArg *regexp.Regexp = regexp.MustCompile(`(?:([\w-]+)=)?("(?:[^"\\]|\\.)*"|\S+)`)
+
+// ShortcodeData is what shortcode templates see
+type ShortcodeData struct {
+	Page   *Page
+	Name   string
+	Params map[string]string // Named arguments, name="value"
+	Args   []string          // Positional arguments
+	Inner  string            // Content between opening and closing tag
+}
+
+// Get returns a named argument, or a positional one for an int
+func (s *ShortcodeData) Get(key interface{}) string {
+	switch key := key.(type) {
+	case int:
+		if key >= 0 && key < len(s.Args) {
+			return s.Args[key]
+		}
+	case string:
+		return s.Params[key]
+	}
+	return ""
+}
+
+func (site *Site) loadShortcodes() error {
+	site.shortcodes = make(map[string]*PlyTemplate)
+
+	dir := filepath.Join(site.plyPath, shortcodesDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		template, err := NewPlyTemplate(site, filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		site.shortcodes[strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))] = template
+	}
+
+	// Built-in shortcodes, unless the site has its own
+	if site.shortcodes["search"] == nil {
+		template, err := parsePlyTemplate(site, filepath.Join(dir, "search.html"), []byte(searchShortcode))
+		if err != nil {
+			return err
+		}
+		site.shortcodes["search"] = template
+	}
+
+	return nil
+}
+
+type shortcodeTag struct {
+	start, end int
+	name       string
+	args       string
+	closing    bool
+	selfClose  bool
+	escaped    string
+}
+
+func findShortcodeTags(content []byte) (tags []shortcodeTag) {
+	for _, m := range reShortcode.FindAllSubmatchIndex(content, -1) {
+		tag := shortcodeTag{start: m[0], end: m[1]}
+		if inner := string(content[m[2]:m[3]]); strings.HasPrefix(inner, "/*") {
+			tag.escaped = "{{< " + strings.TrimSpace(inner[2:len(inner)-2]) + " >}}"
+		} else {
+			tag.closing = m[4] >= 0
+			tag.name = string(content[m[6]:m[7]])
+			tag.args = string(content[m[8]:m[9]])
+			tag.selfClose = m[10] >= 0
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// shortcodeCall is a shortcode found in content, with the content between
+// its opening and closing tag
+type shortcodeCall struct {
+	tag   shortcodeTag
+	inner []byte
+}
+
+// extractShortcodes replaces the shortcodes in markdown content by
+// placeholders, so the markdown renderer leaves them alone. They are executed
+// with executeShortcodes once the markdown is rendered, so shortcodes can use
+// the headings of the page, and put back with replaceShortcodes.
+func extractShortcodes(content []byte) ([]byte, []shortcodeCall, error) {
+	tags := findShortcodeTags(content)
+	if len(tags) == 0 {
+		return content, nil, nil
+	}
+
+	var calls []shortcodeCall
+	var result bytes.Buffer
+	last := 0
+	for i := 0; i < len(tags); i++ {
+		tag := tags[i]
+		result.Write(content[last:tag.start])
+		last = tag.end
+
+		if tag.closing && tag.escaped == "" {
+			return nil, nil, errors.New("shortcode \"" + tag.name + "\" closed without being opened")
+		}
+
+		// Escaped tags are placeholders too, so templated markdown doesn't see them
+		var inner []byte
+		if !tag.selfClose && tag.escaped == "" {
+			if closing := findClosingTag(tags, i); closing > 0 {
+				inner = content[tag.end:tags[closing].start]
+				last = tags[closing].end
+				i = closing
+			}
+		}
+
+		fmt.Fprintf(&result, "plyshortcode%dx", len(calls))
+		calls = append(calls, shortcodeCall{tag, inner})
+	}
+	result.Write(content[last:])
+
+	return result.Bytes(), calls, nil
+}
+
+// executeShortcodes returns the output of shortcodes, recording what they
+// depend on and log in deps and log
+func (p *Page) executeShortcodes(calls []shortcodeCall, deps *pageDeps, log *bytes.Buffer) ([][]byte, error) {
+	outputs := make([][]byte, len(calls))
+	for i, call := range calls {
+		if call.tag.escaped != "" {
+			outputs[i] = []byte(htmlEscaper.Replace(call.tag.escaped))
+			continue
+		}
+
+		output, err := p.executeShortcode(call.tag, call.inner, deps, log)
+		if err != nil {
+			return nil, err
+		}
+		outputs[i] = output
+	}
+	return outputs, nil
+}
+
+// findClosingTag returns the index of the tag closing tags[open], or -1
+func findClosingTag(tags []shortcodeTag, open int) int {
+	depth := 0
+	for i := open + 1; i < len(tags); i++ {
+		if tags[i].name != tags[open].name || tags[i].selfClose || tags[i].escaped != "" {
+			continue
+		}
+		if !tags[i].closing {
+			depth++
+		} else if depth > 0 {
+			depth--
+		} else {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceShortcodes puts shortcode output back in place of the placeholders,
+// without the paragraph a shortcode on its own line ends up in
+func replaceShortcodes(content []byte, outputs [][]byte) []byte {
+	for i := len(outputs) - 1; i >= 0; i-- {
+		placeholder := []byte(fmt.Sprintf("plyshortcode%dx", i))
+		paragraph := append(append([]byte("<p>"), placeholder...), "</p>"...)
+		content = bytes.Replace(content, paragraph, outputs[i], -1)
+		content = bytes.Replace(content, placeholder, outputs[i], -1)
+	}
+	return content
+}
+
+func (p *Page) executeShortcode(tag shortcodeTag, inner []byte, deps *pageDeps, log *bytes.Buffer) ([]byte, error) {
+	t := p.Site.shortcodes[tag.name]
+	if t == nil {
+		return nil, errors.New("unknown shortcode \"" + tag.name + "\"")
+	}
+
+	// Shortcodes can be nested
+	inner, calls, err := extractShortcodes(inner)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := p.executeShortcodes(calls, deps, log)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &ShortcodeData{
+		Page:   p,
+		Name:   tag.name,
+		Params: make(map[string]string),
+		Inner:  string(replaceShortcodes(inner, outputs)),
+	}
+	for _, m := range reShortcodeArg.FindAllStringSubmatch(tag.args, -1) {
+		value := m[2]
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, errors.New("shortcode \"" + tag.name + "\": bad argument " + m[0])
+			}
+		}
+		if m[1] != "" {
+			data.Params[m[1]] = value
+		} else {
+			data.Args = append(data.Args, value)
+		}
+	}
+
+	deps.addFile(t.path)
+	if t.usesSite {
+		deps.Site = true
+	}
+	t, err = t.bind(p.Path, deps, log)
+	if err != nil {
+		return nil, err
+	}
+	t.dir = filepath.Dir(p.Path.AbsSrc) // Urls in shortcodes are relative to the page
+
+	var buffer bytes.Buffer
+	if err := t.template.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buffer.Bytes()), nil
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/atmoz/ply/fileutil"
 )
@@ -17,21 +19,62 @@ const defaultIgnore string = `/\.`
 const defaultFileMode os.FileMode = 0644
 const defaultDirMode os.FileMode = 0755
 
+// Files and directories in .ply configuring ply, which are not copied to target
+var plyReservedFiles = []string{taxonomiesFile, shortcodesDir, configFile, dataDir}
+
+// Templates for generated pages, e.g. ply.tag.template
+var reNamedTemplate *regexp.Regexp = regexp.MustCompile(`^ply\.\w+\.template$`)
+
 type Site struct {
 	Pages      []*Page
 	SourcePath string
 	TargetPath string
+	Title      string
+	Params     map[string]interface{}
+	Data       map[string]interface{}
 	Tags       map[string][]*Page
+	Taxonomies map[string]map[string][]*Page
 
-	plyPath         string
-	includeMarkdown bool
-	includeTemplate bool
-	prettyUrls      bool
-	keepLinks       bool
-	allowExec       bool
-	copyOptions     *fileutil.CopyOptions
+	plyPath          string
+	taxonomies       map[string]string // Plural name -> singular name
+	includeMarkdown  bool
+	includeTemplate  bool
+	prettyUrls       bool
+	keepLinks        bool
+	allowExec        bool
+	buildDrafts      bool
+	buildFuture      bool
+	buildExpired     bool
+	paginate         int
+	highlightStyle   string
+	highlightClasses bool
+	lineNumbers      bool
+	headingLinks     bool
+	renderer         string
+	markdown         []string
+	templateMarkdown bool
+	redirects        string
+	baseUrl          string
+	search           bool
+	searchFields     []string
+	incremental      bool
+	sync             bool
+	dryRun           bool
+	checkLinks       bool
+	copyOptions      *fileutil.CopyOptions
+	flags            *siteConfig     // Options given as flags, see configure
+	disabled         map[string]bool // Options turned off with --no-<option>
+	cache            *buildCache
 
-	templates map[string]*PlyTemplate
+	templates  map[string]*PlyTemplate
+	shortcodes map[string]*PlyTemplate
+	refs       map[string]*Page
+	dirConfigs map[string]*dirConfig
+	named      map[string]*PlyTemplate
+	generated  []*Page
+	written    map[string]bool
+	jobs       int
+	lock       sync.RWMutex
 }
 
 func (site *Site) Init() (err error) {
@@ -55,32 +98,70 @@ func (site *Site) Init() (err error) {
 		return errors.New("Target path can't be the same as source path")
 	}
 
-	if site.copyOptions == nil {
-		site.copyOptions = new(fileutil.CopyOptions)
-		site.copyOptions.IgnoreRegex = append(
-			site.copyOptions.IgnoreRegex, regexp.MustCompile(defaultIgnore))
-	}
-
-	site.copyOptions.IgnoreRegex = append(
-		site.copyOptions.IgnoreRegex, regexp.MustCompile("^"+regexp.QuoteMeta(site.TargetPath)))
-
 	if site.plyPath == "" {
 		site.plyPath = filepath.Join(site.SourcePath, ".ply")
 	}
 
+	if err := site.configure(); err != nil {
+		return err
+	}
+
+	site.reset()
+	return nil
+}
+
+// reset forgets everything collected by a previous build
+func (site *Site) reset() {
+	site.Pages = nil
 	site.Tags = make(map[string][]*Page)
+	site.Taxonomies = map[string]map[string][]*Page{"tags": site.Tags}
 	site.templates = make(map[string]*PlyTemplate)
-	return nil
+	site.named = make(map[string]*PlyTemplate)
+	site.dirConfigs = make(map[string]*dirConfig)
+	site.generated = nil
+	site.written = make(map[string]bool)
 }
 
+// Build builds the site into the target. Markdown and templates are cleaned
+// from the target even when the build fails, so they aren't published.
 func (site *Site) Build() error {
+	err := site.build()
+	if cleanErr := filepath.Walk(site.TargetPath, site.cleanWalk); err == nil {
+		err = cleanErr
+	}
+	if err == nil && site.sync {
+		err = site.syncTarget()
+	}
+	return err
+}
+
+func (site *Site) build() error {
+	site.reset()
+
+	if err := site.loadData(); err != nil {
+		return err
+	}
+
+	if err := site.loadTaxonomies(); err != nil {
+		return err
+	}
+
+	if err := site.loadShortcodes(); err != nil {
+		return err
+	}
+
 	if site.SourcePath != site.TargetPath {
 		if err := fileutil.CopyDirectory(site.SourcePath, site.TargetPath, site.copyOptions); err != nil {
 			return err
 		}
 
 		if info, err := os.Stat(site.plyPath); !os.IsNotExist(err) && info.IsDir() {
-			if err := fileutil.CopyDirectory(site.plyPath, site.TargetPath, nil); err != nil {
+			plyCopyOptions := &fileutil.CopyOptions{OnCopy: site.markWritten}
+			for _, name := range plyReservedFiles {
+				plyCopyOptions.IgnoreRegex = append(plyCopyOptions.IgnoreRegex,
+					regexp.MustCompile("^"+regexp.QuoteMeta(filepath.Join(site.plyPath, name))+"($|/)"))
+			}
+			if err := fileutil.CopyDirectory(site.plyPath, site.TargetPath, plyCopyOptions); err != nil {
 				return err
 			}
 		}
@@ -90,35 +171,146 @@ func (site *Site) Build() error {
 		return err
 	}
 
-	for _, p := range site.Pages {
-		if content, err := p.parse(); err == nil {
-			if site.prettyUrls {
-				if err = os.MkdirAll(p.Path.AbsDir, defaultDirMode); err != nil {
-					return err
-				}
-			}
-			if err := ioutil.WriteFile(p.Path.Abs, content, defaultFileMode); err != nil {
-				return err
+	if err := site.indexRefs(); err != nil {
+		return err
+	}
+
+	for _, taxonomy := range site.taxonomyNames() {
+		if err := site.addTermPages(taxonomy, site.taxonomies[taxonomy], site.Taxonomies[taxonomy]); err != nil {
+			return err
+		}
+	}
+
+	var dirty map[*Page]bool
+	if site.incremental {
+		site.cache = site.loadBuildCache()
+		dirty = site.dirtyPages()
+	}
+
+	deps := make(map[string]*pageDeps)
+	var pages []*Page
+	for _, p := range site.allPages() {
+		if dirty != nil && !dirty[p] {
+			deps[p.Path.Rel] = site.cache.Pages[p.Path.Rel]
+			for _, output := range deps[p.Path.Rel].Outputs {
+				site.markWritten(output)
 			}
-			fmt.Println("Page:", p.Path.Abs)
 		} else {
-			fmt.Println(err)
-			os.Exit(1)
+			pages = append(pages, p)
+		}
+	}
+
+	err := site.renderPages(pages, func(p *Page, content []byte) error {
+		if err := os.MkdirAll(p.Path.AbsDir, defaultDirMode); err != nil {
+			return err
 		}
+		if err := ioutil.WriteFile(p.Path.Abs, content, defaultFileMode); err != nil {
+			return err
+		}
+		fmt.Print(p.log.String())
+		fmt.Println("Page:", p.Path.Abs)
+		deps[p.Path.Rel] = p.deps
+		for _, output := range p.deps.Outputs {
+			site.markWritten(output)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := site.writeRedirects(); err != nil {
+		return err
+	}
+
+	if err := site.writeSitemap(); err != nil {
+		return err
 	}
 
-	if err := filepath.Walk(site.TargetPath, site.cleanWalk); err != nil {
+	if err := site.writeFeeds(); err != nil {
 		return err
 	}
 
+	if err := site.writeSearchIndex(); err != nil {
+		return err
+	}
+
+	if site.incremental {
+		if err := site.saveBuildCache(deps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderJobs returns how many pages are rendered in parallel
+func (site *Site) renderJobs() int {
+	if site.jobs <= 0 {
+		return runtime.NumCPU()
+	}
+	return site.jobs
+}
+
+type renderResult struct {
+	content []byte
+	err     error
+}
+
+// renderPages renders pages in parallel, but hands the results to done one
+// by one in the original order, so output and logs stay deterministic.
+func (site *Site) renderPages(pages []*Page, done func(p *Page, content []byte) error) error {
+	jobs := site.renderJobs()
+
+	results := make([]chan renderResult, len(pages))
+	for i := range results {
+		results[i] = make(chan renderResult, 1)
+	}
+
+	queue := make(chan int)
+	stop := make(chan bool)
+	defer close(stop)
+
+	go func() {
+		defer close(queue)
+		for i := range pages {
+			select {
+			case queue <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < jobs; w++ {
+		go func() {
+			for i := range queue {
+				content, err := pages[i].parse()
+				results[i] <- renderResult{content, err}
+			}
+		}()
+	}
+
+	for i, p := range pages {
+		result := <-results[i]
+		if result.err != nil {
+			return errors.New(p.Path.Rel + ": " + result.err.Error())
+		}
+		if err := done(p, result.content); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (site *Site) buildWalk(path string, f os.FileInfo, err error) error {
 	basename := filepath.Base(path)
 	if strings.HasSuffix(basename, ".md") {
-		if page, err := NewPage(site, path); err == nil {
+		if page, err := NewPage(site, path); err == nil && page.IsPublished() {
 			site.Pages = append(site.Pages, page)
+		} else if err == nil {
+			os.Remove(path) // Don't leak unpublished markdown with --include-markdown
 		} else {
 			return err
 		}
@@ -126,16 +318,71 @@ func (site *Site) buildWalk(path string, f os.FileInfo, err error) error {
 		if template, err := NewPlyTemplate(site, path); err != nil {
 			return err
 		} else {
-			site.templates[filepath.Dir(path)] = template
+			site.addTemplate(filepath.Dir(path), template)
+		}
+	} else if basename == dirConfigFile && filepath.Dir(path) != site.TargetPath {
+		if err := site.addDirConfig(path); err != nil {
+			return err
+		}
+	} else if reNamedTemplate.MatchString(basename) {
+		if template, err := newNamedTemplate(site, path); err != nil {
+			return err
+		} else {
+			site.named[path] = template
 		}
 	}
 	return nil
 }
 
+// allPages returns the pages from the source followed by generated pages
+func (site *Site) allPages() []*Page {
+	return append(site.Pages[:len(site.Pages):len(site.Pages)], site.generated...)
+}
+
+// findTemplate looks for a named template in dir and its parents, the same
+// way ply.template files are applied
+func (site *Site) findTemplate(dir, name string) *PlyTemplate {
+	for {
+		if template := site.named[filepath.Join(dir, name)]; template != nil {
+			return template
+		}
+
+		if rel, err := filepath.Rel(site.TargetPath, dir); err != nil || rel == "." {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (site *Site) template(dir string) *PlyTemplate {
+	site.lock.RLock()
+	defer site.lock.RUnlock()
+	return site.templates[dir]
+}
+
+func (site *Site) addTemplate(dir string, template *PlyTemplate) {
+	site.lock.Lock()
+	defer site.lock.Unlock()
+	site.templates[dir] = template
+}
+
+func (site *Site) markWritten(path string) {
+	site.lock.Lock()
+	defer site.lock.Unlock()
+	site.written[path] = true
+}
+
+func (site *Site) addTerm(taxonomy, term string, p *Page) {
+	site.lock.Lock()
+	defer site.lock.Unlock()
+	site.Taxonomies[taxonomy][term] = append(site.Taxonomies[taxonomy][term], p)
+}
+
 func (site *Site) cleanWalk(path string, f os.FileInfo, err error) error {
 	cleanMarkdown := !site.includeMarkdown && strings.HasSuffix(path, ".md")
-	cleanTemplate := !site.includeTemplate && filepath.Base(path) == "ply.template"
-	if cleanMarkdown || cleanTemplate {
+	basename := filepath.Base(path)
+	cleanTemplate := !site.includeTemplate && (basename == "ply.template" || reNamedTemplate.MatchString(basename))
+	if cleanMarkdown || cleanTemplate || basename == dirConfigFile {
 		os.Remove(path)
 	}
 	return nil
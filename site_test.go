@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/atmoz/ply/fileutil"
 )
@@ -122,3 +126,839 @@ func TestExampleGallery(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIncrementalBuild(t *testing.T) {
+	var site Site
+	site.incremental = true
+	site.SourcePath = copyTestDir("one_template")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged pages must not be rendered again
+	output := filepath.Join(site.TargetPath, "test.html")
+	ioutil.WriteFile(output, []byte("untouched"), 0644)
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(output); string(content) != "untouched" {
+		t.Error("unchanged page was rendered again")
+	}
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "test.md"), []byte("# changed"), 0644)
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(output); !strings.Contains(string(content), ">changed</h1>") {
+		t.Error("changed page was not rendered again:", string(content))
+	}
+}
+
+func TestSync(t *testing.T) {
+	var site Site
+	site.sync = true
+	site.SourcePath = copyTestDir("one_page")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := filepath.Join(site.TargetPath, "old", "page.html")
+	hidden := filepath.Join(site.TargetPath, ".hidden")
+	os.MkdirAll(filepath.Dir(stale), 0755)
+	ioutil.WriteFile(stale, []byte("stale"), 0644)
+	ioutil.WriteFile(hidden, []byte("hidden"), 0644)
+
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Error("stale file was not removed")
+	}
+	if _, err := os.Stat(hidden); err != nil {
+		t.Error("hidden file was removed")
+	}
+	if _, err := os.Stat(filepath.Join(site.TargetPath, "test.html")); err != nil {
+		t.Error("page was removed")
+	}
+}
+
+func TestSyncSourceInTarget(t *testing.T) {
+	var site Site
+	site.sync = true
+	site.TargetPath = copyTestDir("one_page")
+	defer os.RemoveAll(site.TargetPath)
+	site.SourcePath = filepath.Join(site.TargetPath, "src")
+	os.Mkdir(site.SourcePath, 0755)
+
+	if err := site.Init(); err == nil {
+		t.Error("Expected error with source inside target and --sync")
+	}
+}
+
+func TestDryRunWithoutSync(t *testing.T) {
+	var site Site
+	site.dryRun = true
+	site.SourcePath = copyTestDir("one_page")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err == nil {
+		t.Error("Expected error with --dry-run without --sync")
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("drafts")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	site.copyOptions.IgnoreRegex = append(site.copyOptions.IgnoreRegex, regexp.MustCompile(`ply\.expected$`))
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !compareAllExpectedFiles(&site) {
+		t.Fail()
+	}
+	for _, name := range []string{"draft.html", "future.html", "expired.html"} {
+		if _, err := os.Stat(filepath.Join(site.TargetPath, name)); !os.IsNotExist(err) {
+			t.Error(name, "should not be rendered")
+		}
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("check_links")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	broken, err := site.CheckLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(site.SourcePath, "index.md")
+	expected := []BrokenLink{
+		{source, 5, "old.html", "missing file"},
+		{source, 5, "img/missing.png", "missing file"},
+		{source, 7, "sub/page.html#nowhere", "missing anchor"},
+		{source, 9, "sub/page.html#elsewhere", "missing anchor"},
+	}
+	if len(broken) != len(expected) {
+		t.Fatal("Expected", expected, "but got", broken)
+	}
+	for i := range expected {
+		if broken[i] != expected[i] {
+			t.Error("Expected", expected[i], "but got", broken[i])
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "refs") {
+		t.Fail()
+	}
+}
+
+func TestUnknownRef(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("refs")
+	defer os.RemoveAll(site.SourcePath)
+
+	content := []byte("[Nowhere](ref:nowhere)\n")
+	if err := ioutil.WriteFile(filepath.Join(site.SourcePath, "broken.md"), content, defaultFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err == nil || !strings.Contains(err.Error(), "unknown ref \"nowhere\"") {
+		t.Error("Expected unknown ref error, but got", err)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	var site Site
+	site.redirects = "netlify"
+	if !buildAndCompare(&site, "aliases") {
+		t.Fail()
+	}
+}
+
+func TestSitemap(t *testing.T) {
+	var site Site
+	site.baseUrl = "https://example.com/docs/"
+	if !buildAndCompare(&site, "sitemap") {
+		t.Fail()
+	}
+}
+
+func TestSitemapIndex(t *testing.T) {
+	defer func(max int) { sitemapMaxUrls = max }(sitemapMaxUrls)
+	sitemapMaxUrls = 1
+
+	var site Site
+	site.baseUrl = "https://example.com"
+	site.SourcePath = copyTestDir("sitemap")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, _ := ioutil.ReadFile(filepath.Join(site.TargetPath, "sitemap.xml"))
+	for _, name := range []string{"sitemap-1.xml", "sitemap-2.xml"} {
+		if !strings.Contains(string(index), "<loc>https://example.com/"+name+"</loc>") {
+			t.Error("Sitemap index should list", name)
+		}
+		if _, err := os.Stat(filepath.Join(site.TargetPath, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	var site Site
+	site.baseUrl = "https://example.com/"
+	if !buildAndCompare(&site, "feeds") {
+		t.Fail()
+	}
+}
+
+func TestFeedFormatsCopied(t *testing.T) {
+	p := &Page{Path: &Path{Rel: "index.md"}, Meta: map[string]interface{}{"feed": true}}
+	names, err := p.feedFormats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names[0] = "changed"
+	if feedFormats[0] == "changed" {
+		t.Error("Expected the feed formats of a page to be a copy")
+	}
+}
+
+func TestFeedsNeedBaseUrl(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("feeds")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err == nil || !strings.Contains(err.Error(), "--base-url") {
+		t.Error("Expected error about --base-url, got", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	var site Site
+	site.search = true
+	if !buildAndCompare(&site, "search") {
+		t.Fail()
+	}
+}
+
+func TestSearchFields(t *testing.T) {
+	var site Site
+	site.search = true
+	site.searchFields = []string{"title", "url"}
+	site.SourcePath = copyTestDir("search")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, _ := ioutil.ReadFile(filepath.Join(site.TargetPath, "search.json"))
+	expected := `[{"title":"Install","url":"docs/install.html"},{"title":"Home","url":"index.html"}]` + "\n"
+	if string(index) != expected {
+		t.Errorf("Expected %s, got %s", expected, index)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "config") {
+		t.Fail()
+	}
+	if _, err := os.Stat(filepath.Join(site.TargetPath, "docs", "ply.yaml")); !os.IsNotExist(err) {
+		t.Error("ply.yaml should not be in target")
+	}
+}
+
+func TestConfigFlagsWin(t *testing.T) {
+	var site Site
+	site.Title = "Flag"
+	site.SourcePath = copyTestDir("config")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if site.Title != "Flag" || !site.headingLinks || site.Params["author"] != "Jane" {
+		t.Error("Expected config options where flags aren't given, got", site.Title, site.headingLinks, site.Params)
+	}
+}
+
+func TestConfigDisabled(t *testing.T) {
+	var site Site
+	site.disabled = map[string]bool{"heading-links": true}
+	site.SourcePath = copyTestDir("config")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if site.headingLinks {
+		t.Error("Expected --no-heading-links to turn off heading-links from the config")
+	}
+
+	site.disabled = map[string]bool{"nonsense": true}
+	if err := site.configure(); err == nil {
+		t.Error("Expected error for --no-nonsense")
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("config")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(site.SourcePath, ".ply", "config.yaml")
+	ioutil.WriteFile(config, []byte("title: Changed\n"), defaultFileMode)
+	if err := site.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if site.Title != "Changed" || site.headingLinks || len(site.Params) != 0 {
+		t.Error("Expected the changed config only, got", site.Title, site.headingLinks, site.Params)
+	}
+}
+
+func TestConfigTwice(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("config")
+	defer os.RemoveAll(site.SourcePath)
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "ply.yaml"), []byte("title: Other\n"), defaultFileMode)
+	if err := site.Init(); err == nil {
+		t.Error("Expected error with both .ply/config.yaml and ply.yaml")
+	}
+}
+
+func TestData(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "data") {
+		t.Fail()
+	}
+}
+
+func TestDataConflict(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("data")
+	defer os.RemoveAll(site.SourcePath)
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, ".ply", "data", "site.json"), []byte("{}"), defaultFileMode)
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err == nil {
+		t.Error("Expected error with both site.yaml and site.json")
+	}
+}
+
+func TestDataChanged(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("data")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, ".ply", "data", "site.yaml"), []byte("name: Changed\n"), defaultFileMode)
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(site.TargetPath, "index.html"))
+	if !strings.Contains(string(content), "<title>Home - Changed</title>") {
+		t.Error("Expected the changed data in the page, got", string(content))
+	}
+}
+
+func TestDataFunctions(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "data_functions") {
+		t.Fail()
+	}
+}
+
+func TestTags(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "tags") {
+		t.Fail()
+	}
+}
+
+func TestTagTemplateContent(t *testing.T) {
+	for _, body := range []string{"{{ .Content }}", "{{ .TableOfContents }}"} {
+		var site Site
+		site.SourcePath = copyTestDir("tags")
+		defer os.RemoveAll(site.SourcePath)
+
+		ioutil.WriteFile(filepath.Join(site.SourcePath, "ply.tag.template"), []byte(body), defaultFileMode)
+		if err := site.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := site.Build(); err == nil || !strings.Contains(err.Error(), "isn't known while ply.tag.template is executed") {
+			t.Error("Expected an error for", body, "but got", err)
+		}
+	}
+}
+
+func TestTagWithoutSlug(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("tags")
+	defer os.RemoveAll(site.SourcePath)
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "c.md"), []byte("---\ntags: [\"++\"]\n---\n# C\n"), defaultFileMode)
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err == nil || !strings.Contains(err.Error(), `c.html: tag "++"`) {
+		t.Error("Expected error about the tag of c.html, got", err)
+	}
+}
+
+func TestTermPageCollision(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("tags")
+	defer os.RemoveAll(site.SourcePath)
+
+	os.Mkdir(filepath.Join(site.SourcePath, ".ply"), 0755)
+	ioutil.WriteFile(filepath.Join(site.SourcePath, ".ply", "taxonomies.yaml"), []byte("Tags: label\n"), defaultFileMode)
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "ply.label.template"), []byte("{{ .Title }}"), defaultFileMode)
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err == nil || !strings.Contains(err.Error(), "would both be generated") {
+		t.Error("Expected error about term pages generated twice, got", err)
+	}
+}
+
+func TestTaxonomies(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "taxonomies") {
+		t.Fail()
+	}
+}
+
+func TestPagination(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "pagination") {
+		t.Fail()
+	}
+}
+
+func TestHeadings(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "headings") {
+		t.Fail()
+	}
+}
+
+func TestShortcodes(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "shortcodes") {
+		t.Fail()
+	}
+}
+
+func TestShortcodesPretty(t *testing.T) {
+	var site Site
+	site.prettyUrls = true
+	if !buildAndCompare(&site, "shortcodes_pretty") {
+		t.Fail()
+	}
+}
+
+func TestShortcodeSelfReference(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("shortcodes")
+	defer os.RemoveAll(site.SourcePath)
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, ".ply", "shortcodes", "self.html"), []byte("{{ .Page.Content }}"), defaultFileMode)
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "self.md"), []byte("# Self\n\n{{< self >}}\n"), defaultFileMode)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	err := buildWithTimeout(t, &site)
+	if err == nil || !strings.Contains(err.Error(), "content of self.html depends on itself") {
+		t.Error("Expected error about self.html depending on itself, got", err)
+	}
+}
+
+// buildWithTimeout builds the site, and fails the test if it hangs
+func buildWithTimeout(t *testing.T, site *Site) error {
+	done := make(chan error, 1)
+	go func() { done <- site.Build() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Build did not finish")
+		return nil
+	}
+}
+
+func TestTemplateMarkdown(t *testing.T) {
+	var site Site
+	if !buildAndCompare(&site, "template_markdown") {
+		t.Fail()
+	}
+}
+
+func TestTemplateMarkdownSelfReference(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("template_markdown")
+	defer os.RemoveAll(site.SourcePath)
+
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "self.md"), []byte("---\ntemplate: true\n---\n# Self\n\n{{ .TableOfContents }}\n"), defaultFileMode)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	err := buildWithTimeout(t, &site)
+	if err == nil || !strings.Contains(err.Error(), "content of self.html depends on itself") {
+		t.Error("Expected error about self.html depending on itself, got", err)
+	}
+}
+
+func TestTemplateMarkdownCycle(t *testing.T) {
+	var site Site
+	site.jobs = 2
+	site.SourcePath = copyTestDir("template_markdown")
+	defer os.RemoveAll(site.SourcePath)
+
+	for _, names := range [][2]string{{"a", "b"}, {"b", "a"}} {
+		content := "---\ntemplate: true\n---\n# " + names[0] + "\n\n" +
+			`{{ range .Site.Pages }}{{ if eq .Title "` + names[1] + `" }}{{ .Content }}{{ end }}{{ end }}` + "\n"
+		ioutil.WriteFile(filepath.Join(site.SourcePath, names[0]+".md"), []byte(content), defaultFileMode)
+	}
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	err := buildWithTimeout(t, &site)
+	if err == nil || !regexp.MustCompile(`content of [ab]\.html depends on itself`).MatchString(err.Error()) {
+		t.Error("Expected error about a.html or b.html depending on itself, got", err)
+	}
+}
+
+func TestCommonmark(t *testing.T) {
+	var site Site
+	site.renderer = "commonmark"
+	site.highlightStyle = "bw"
+	if !buildAndCompare(&site, "commonmark") {
+		t.Fail()
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	var site Site
+	site.highlightStyle = "bw"
+	if !buildAndCompare(&site, "highlight") {
+		t.Fail()
+	}
+}
+
+func TestHighlightClasses(t *testing.T) {
+	var site Site
+	site.highlightStyle = "bw"
+	site.highlightClasses = true
+	site.lineNumbers = true
+	if !buildAndCompare(&site, "highlight_classes") {
+		t.Fail()
+	}
+}
+
+func TestMarkdownOptions(t *testing.T) {
+	var site Site
+	site.markdown = []string{"hard-line-break", "-strikethrough", "-footnotes"}
+	if !buildAndCompare(&site, "markdown_options") {
+		t.Fail()
+	}
+}
+
+func TestMarkdownUnknownOption(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("markdown_options")
+	defer os.RemoveAll(site.SourcePath)
+
+	site.markdown = []string{"no-such-option"}
+	if err := site.Init(); err == nil || err.Error() != "Unknown markdown option: no-such-option" {
+		t.Error("Expected unknown markdown option error, got", err)
+	}
+
+	site.markdown = nil
+	site.flags = nil
+	ioutil.WriteFile(filepath.Join(site.SourcePath, "list.md"), []byte("---\nmarkdown: [no-such-option]\n---\nOne\n"), defaultFileMode)
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err == nil || !strings.Contains(err.Error(), "no-such-option") {
+		t.Error("Expected unknown markdown option error from the metadata, got", err)
+	}
+}
+
+func TestTemplateBoundOnlyWhenNeeded(t *testing.T) {
+	var site Site
+	p := &Page{Site: &site, Path: &Path{}}
+	r := newPageRender(p, p.Path, 1, nil)
+
+	shared, _ := parsePlyTemplate(&site, "ply.template", []byte("{{ .Content }}"))
+	if bound, _ := shared.forPage(r); bound != shared {
+		t.Error("Expected the template to be shared without --incremental")
+	}
+
+	usesPage, _ := parsePlyTemplate(&site, "ply.template", []byte(`{{ ref "home" }}`))
+	if bound, _ := usesPage.forPage(r); bound == usesPage {
+		t.Error("Expected a bound copy of a template using ref")
+	}
+
+	site.incremental = true
+	if bound, _ := shared.forPage(r); bound == shared {
+		t.Error("Expected a bound copy with --incremental")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	defer func(interval time.Duration) { watchInterval = interval }(watchInterval)
+	watchInterval = 10 * time.Millisecond
+
+	var site Site
+	site.SourcePath = copyTestDir("one_page")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt := make(chan bool, 1)
+	stop := make(chan bool)
+	done := make(chan error)
+	go func() {
+		done <- site.watch(func() {
+			select {
+			case rebuilt <- true:
+			default:
+			}
+		}, stop)
+	}()
+
+	source := filepath.Join(site.SourcePath, "test.md")
+	changeUntilRebuilt(t, source, rebuilt)
+
+	// A broken page is reported, and watching goes on
+	ioutil.WriteFile(source, []byte("---\ntitle: a: b\n---\n"), defaultFileMode)
+	time.Sleep(50 * watchInterval)
+	if _, err := os.Stat(filepath.Join(site.TargetPath, "test.md")); !os.IsNotExist(err) {
+		t.Error("Expected the markdown to be cleaned from the target after a failed build")
+	}
+	changeUntilRebuilt(t, source, rebuilt)
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(site.TargetPath, "test.html"))
+	if !strings.Contains(string(content), "Changed") {
+		t.Error("Expected the rebuilt page, got", string(content))
+	}
+}
+
+// changeUntilRebuilt keeps changing a page until it's rebuilt, as the first
+// change may come before watching
+func changeUntilRebuilt(t *testing.T, source string, rebuilt chan bool) {
+	timeout := time.After(10 * time.Second)
+	for i := 1; ; i++ {
+		ioutil.WriteFile(source, []byte(fmt.Sprintf("# Changed %d\n", i)), defaultFileMode)
+		select {
+		case <-rebuilt:
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Expected a rebuild after changing the source")
+		}
+	}
+}
+
+func TestBrokenFrontMatter(t *testing.T) {
+	for _, meta := range []string{"title: a: b", "title: [a]"} {
+		var site Site
+		site.SourcePath = copyTestDir("one_page")
+		defer os.RemoveAll(site.SourcePath)
+
+		ioutil.WriteFile(filepath.Join(site.SourcePath, "test.md"), []byte("---\n"+meta+"\n---\n# Test\n"), defaultFileMode)
+		if err := site.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := site.Build(); err == nil || !strings.HasPrefix(err.Error(), "test.html: ") {
+			t.Error("Expected an error naming the page for", meta, "but got", err)
+		}
+		if _, err := os.Stat(filepath.Join(site.TargetPath, "test.md")); !os.IsNotExist(err) {
+			t.Error("Expected the markdown to be cleaned from the target after a failed build")
+		}
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	var site Site
+	site.SourcePath = copyTestDir("one_page")
+	defer os.RemoveAll(site.SourcePath)
+
+	if err := site.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	page := httptest.NewRecorder()
+	site.serveFile(page, httptest.NewRequest("GET", "/test.html", nil))
+	if !strings.Contains(page.Body.String(), reloadUrl) {
+		t.Error("Expected the reload script in the page, got", page.Body.String())
+	}
+
+	reloader := newReloader()
+	server := httptest.NewServer(reloader)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	events := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		events <- line
+	}()
+
+	// Keep reloading, as the first reload may come before the client is added
+	timeout := time.After(10 * time.Second)
+	for {
+		reloader.Reload()
+		select {
+		case event := <-events:
+			if event != "data: reload\n" {
+				t.Error("Expected a reload event, got", event)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Expected a reload event")
+		}
+	}
+}
+
+// buildWithJobs builds a copy of a fixture with a number of render jobs, and
+// returns the printed output and the target files, without the temp dir
+func buildWithJobs(t *testing.T, path string, jobs int) (string, map[string]string) {
+	var site Site
+	site.jobs = jobs
+	site.SourcePath = copyTestDir(path)
+	defer os.RemoveAll(site.SourcePath)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		content, _ := ioutil.ReadAll(r)
+		output <- string(content)
+	}()
+
+	os.Stdout = w
+	err = site.Init()
+	if err == nil {
+		err = site.Build()
+	}
+	os.Stdout = stdout
+	w.Close()
+	printed := strings.Replace(<-output, site.SourcePath, "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	filepath.Walk(site.TargetPath, func(path string, f os.FileInfo, err error) error {
+		if err == nil && !f.IsDir() && filepath.Base(path) != buildCacheName {
+			content, _ := ioutil.ReadFile(path)
+			files[strings.TrimPrefix(path, site.SourcePath)] = strings.Replace(string(content), site.SourcePath, "", -1)
+		}
+		return nil
+	})
+	return printed, files
+}
+
+func TestParallelBuild(t *testing.T) {
+	for _, path := range []string{"tags", "refs", "pagination", "shortcodes"} {
+		serialOutput, serialFiles := buildWithJobs(t, path, 1)
+		output, files := buildWithJobs(t, path, 4)
+
+		if output != serialOutput {
+			t.Errorf("%s: expected output\n%s\nbut got\n%s", path, serialOutput, output)
+		}
+		if len(serialFiles) == 0 || !strings.Contains(serialOutput, "Page:") {
+			t.Errorf("%s: expected pages to be built", path)
+		}
+		if len(files) != len(serialFiles) {
+			t.Errorf("%s: expected %d files but got %d", path, len(serialFiles), len(files))
+		}
+		for name, content := range serialFiles {
+			if files[name] != content {
+				t.Errorf("%s: %s differs from the serial build", path, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const sitemapFile string = "sitemap.xml"
+const robotsFile string = "robots.txt"
+const sitemapXmlns string = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// Sitemaps with more urls are split, and listed in a sitemap index
+var sitemapMaxUrls int = 50000
+
+type sitemapUrl struct {
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapUrlSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapUrl `xml:"sitemap"`
+}
+
+// AbsUrl returns the url of a page including --base-url
+func (site *Site) AbsUrl(p *Page) string {
+	return site.absUrlOf(p.Path.Abs)
+}
+
+func (site *Site) absUrlOf(absPath string) string {
+	return strings.TrimSuffix(site.baseUrl, "/") + "/" + site.rootUrlOf(absPath)
+}
+
+// rootUrlOf returns the url of a file in target, relative to the site root
+func (site *Site) rootUrlOf(absPath string) string {
+	rel, err := filepath.Rel(site.TargetPath, absPath)
+	if err != nil {
+		return ""
+	}
+	url := site.prettyUrl(normalizePathToUrl(rel))
+	if url == "./" {
+		return ""
+	}
+	return url
+}
+
+// writeSitemap writes sitemap.xml and robots.txt when --base-url is given,
+// unless the source has its own
+func (site *Site) writeSitemap() error {
+	if site.baseUrl == "" {
+		return nil
+	}
+
+	var urls []sitemapUrl
+	for _, p := range site.allPages() {
+		if include, ok := p.Meta["sitemap"].(bool); ok && !include {
+			continue
+		}
+		url := sitemapUrl{Loc: site.AbsUrl(p)}
+		if lastmod := site.lastmod(p); !lastmod.IsZero() {
+			url.Lastmod = lastmod.Format(time.RFC3339)
+		}
+		urls = append(urls, url)
+	}
+
+	if len(urls) <= sitemapMaxUrls {
+		if err := site.writeXml(sitemapFile, sitemapUrlSet{Xmlns: sitemapXmlns, Urls: urls}); err != nil {
+			return err
+		}
+	} else {
+		index := sitemapIndex{Xmlns: sitemapXmlns}
+		for n := 1; len(urls) > 0; n++ {
+			part := urls
+			if len(part) > sitemapMaxUrls {
+				part = part[:sitemapMaxUrls]
+			}
+			urls = urls[len(part):]
+
+			name := fmt.Sprintf("sitemap-%d.xml", n)
+			if err := site.writeXml(name, sitemapUrlSet{Xmlns: sitemapXmlns, Urls: part}); err != nil {
+				return err
+			}
+			index.Sitemaps = append(index.Sitemaps, sitemapUrl{Loc: strings.TrimSuffix(site.baseUrl, "/") + "/" + name})
+		}
+		if err := site.writeXml(sitemapFile, index); err != nil {
+			return err
+		}
+	}
+
+	robots := "User-agent: *\nDisallow:\n\nSitemap: " + strings.TrimSuffix(site.baseUrl, "/") + "/" + sitemapFile + "\n"
+	return site.writeGenerated(robotsFile, []byte(robots))
+}
+
+func (site *Site) writeXml(name string, v interface{}) error {
+	content, err := marshalXml(v)
+	if err != nil {
+		return err
+	}
+	return site.writeGenerated(name, content)
+}
+
+// writeGenerated writes a file to the target root, unless the source has it
+func (site *Site) writeGenerated(name string, content []byte) error {
+	absPath := filepath.Join(site.TargetPath, name)
+
+	site.lock.RLock()
+	exists := site.written[absPath]
+	site.lock.RUnlock()
+	if exists {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(absPath, content, defaultFileMode); err != nil {
+		return err
+	}
+	fmt.Println("File:", absPath)
+	site.markWritten(absPath)
+	return nil
+}
+
+// lastmod returns when a page was last changed, from the "lastmod" metadata
+// or else the modification time of the source file
+func (site *Site) lastmod(p *Page) time.Time {
+	if t, err := p.metaTime("lastmod"); err == nil && !t.IsZero() {
+		return t
+	}
+	return site.modTime(p)
+}
+
+// srcRel returns the path of the page source, relative to the source root
+func (site *Site) srcRel(p *Page) string {
+	rel, _ := filepath.Rel(site.TargetPath, p.Path.AbsSrc)
+	return rel
+}
+
+// modTime returns the modification time of the page source, or zero for
+// generated pages
+func (site *Site) modTime(p *Page) time.Time {
+	if info, err := os.Stat(filepath.Join(site.SourcePath, site.srcRel(p))); err == nil {
+		return info.ModTime().UTC()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func (site *Site) checkSync() error {
+	if site.dryRun && !site.sync {
+		return errors.New("--dry-run only works with --sync")
+	}
+	if rel, err := filepath.Rel(site.TargetPath, site.SourcePath); site.sync && err == nil && !strings.HasPrefix(rel, "..") {
+		return errors.New("Source path can't be inside target path with --sync")
+	}
+	return nil
+}
+
+// syncTarget removes every file from the target that was neither copied nor
+// written by the current build, e.g. output of renamed or deleted pages.
+// Hidden files (like .git or the build cache) are always left alone.
+func (site *Site) syncTarget() error {
+	var stale []string
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == site.SourcePath {
+			return filepath.SkipDir
+		} else if path != site.TargetPath && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() && !site.written[path] {
+			stale = append(stale, path)
+		}
+		return nil
+	}
+
+	if err := filepath.Walk(site.TargetPath, walkFn); err != nil {
+		return err
+	}
+
+	for _, path := range stale {
+		if site.dryRun {
+			fmt.Println("Would remove:", path)
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Println("Removed:", path)
+
+		// Remove directories left empty, fails silently on non-empty ones
+		for dir := filepath.Dir(path); dir != site.TargetPath; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// taxonomiesFile in .ply declares taxonomies besides tags, as plural: singular
+//
+//	categories: category
+//	authors: author
+const taxonomiesFile string = "taxonomies.yaml"
+
+// TermData is the page data of generated taxonomy pages, like tags/<tag>/
+type TermData struct {
+	Taxonomy string
+	Term     string // Empty on the index page listing all terms
+	Pages    []*Page
+	Terms    map[string][]*Page
+}
+
+func (site *Site) loadTaxonomies() error {
+	site.taxonomies = map[string]string{"tags": "tag"}
+
+	content, err := ioutil.ReadFile(filepath.Join(site.plyPath, taxonomiesFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var declared map[string]string
+	if err := yaml.Unmarshal(content, &declared); err != nil {
+		return errors.New(taxonomiesFile + ": " + err.Error())
+	}
+
+	for plural, singular := range declared {
+		if singular == "" {
+			return errors.New(taxonomiesFile + ": taxonomy \"" + plural + "\" needs a singular name")
+		}
+		site.taxonomies[plural] = singular
+		if site.Taxonomies[plural] == nil {
+			site.Taxonomies[plural] = make(map[string][]*Page)
+		}
+	}
+
+	return nil
+}
+
+func (site *Site) taxonomyNames() []string {
+	names := make([]string, 0, len(site.taxonomies))
+	for name := range site.taxonomies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addTermPages generates <taxonomy>/<term>/index.html for every term, and
+// <taxonomy>/index.html listing all terms. Pages are only generated where a
+// ply.<singular>.template is found.
+func (site *Site) addTermPages(taxonomy, singular string, terms map[string][]*Page) error {
+	templateName := "ply." + singular + ".template"
+	if slugify(taxonomy) == "" {
+		return errors.New(taxonomiesFile + ": taxonomy \"" + taxonomy + "\" has no letters or digits for a directory name")
+	}
+	indexDir := filepath.Join(site.TargetPath, slugify(taxonomy))
+
+	if body := site.findTemplate(indexDir, templateName); body != nil {
+		data := &TermData{Taxonomy: taxonomy, Terms: terms}
+		if err := site.addTermPage(indexDir, taxonomy, body, data); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(terms))
+	for name := range terms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Terms with the same slug share a page
+	bySlug := make(map[string]*TermData)
+	var slugs []string
+	for _, name := range names {
+		slug := slugify(name)
+		if slug == "" {
+			return errors.New(terms[name][0].Path.Rel + ": " + singular + " \"" + name + "\" has no letters or digits for a directory name")
+		}
+		if bySlug[slug] == nil {
+			bySlug[slug] = &TermData{Taxonomy: taxonomy, Term: name, Terms: terms}
+			slugs = append(slugs, slug)
+		}
+		bySlug[slug].Pages = append(bySlug[slug].Pages, terms[name]...)
+	}
+
+	for _, slug := range slugs {
+		dir := filepath.Join(indexDir, slug)
+		if body := site.findTemplate(dir, templateName); body != nil {
+			if err := site.addTermPage(dir, bySlug[slug].Term, body, bySlug[slug]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (site *Site) addTermPage(dir, title string, body *PlyTemplate, data *TermData) error {
+	empty, err := NewEmptyPage(site, filepath.Join(dir, "index.md"))
+	if err != nil {
+		return err
+	}
+
+	// Pages from the source win over generated ones
+	for _, p := range site.Pages {
+		if p.Path.Abs == empty.Path.Abs {
+			return nil
+		}
+	}
+	for _, p := range site.generated {
+		if p.Path.Abs == empty.Path.Abs {
+			return errors.New("\"" + title + "\" and \"" + p.Title + "\" would both be generated as " + p.Path.Rel)
+		}
+	}
+
+	p := &empty.Page
+	p.Title = title
+	p.Meta = make(PageMeta)
+	for key, value := range body.meta {
+		p.Meta[key] = value
+	}
+	p.Data = data
+	p.body = body
+	site.generated = append(site.generated, p)
+	return nil
+}
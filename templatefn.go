@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -10,6 +13,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -19,24 +23,121 @@ import (
 
 type YamlData map[string]interface{}
 
+// Templates matching this use template functions which need the page being
+// rendered, to make links relative to it, log or record what they write
+var rePageUsage *regexp.Regexp = regexp.MustCompile(`\b(ref|searchIndexUrl|exec|templateImport|templateWrite|yamlWrite|jsonWrite)\b`)
+
 type PlyTemplate struct {
 	path     string
+	dir      string // Relative urls are resolved from here
 	site     *Site
+	from     *Path         // Where links made by template functions are relative to
+	deps     *pageDeps     // Where template functions record dependencies
+	log      *bytes.Buffer // Where template functions log to
 	template *template.Template
+	usesSite bool
+	usesPage bool
+	meta     PageMeta // Front matter of a ply.<name>.template, for the pages it generates
 }
 
 func NewPlyTemplate(site *Site, path string) (t *PlyTemplate, err error) {
+	templateContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return &PlyTemplate{path: path, site: site}, err
+	}
+
+	return parsePlyTemplate(site, path, templateContent)
+}
+
+// newNamedTemplate reads a ply.<name>.template, which may start with front
+// matter for the pages it generates
+func newNamedTemplate(site *Site, path string) (*PlyTemplate, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, content, err := splitMetaAndContent(content)
+	if err != nil {
+		rel, _ := filepath.Rel(site.TargetPath, path)
+		return nil, errors.New(rel + ": " + err.Error())
+	}
+
+	t, err := parsePlyTemplate(site, path, content)
+	t.meta = meta
+	return t, err
+}
+
+func parsePlyTemplate(site *Site, path string, templateContent []byte) (t *PlyTemplate, err error) {
 	t = &PlyTemplate{}
 	t.path = path
+	t.dir = filepath.Dir(path)
 	t.site = site
 	t.template = template.New(path).Funcs(t.templateFnMap())
-	templateContent, err := ioutil.ReadFile(path)
+	t.usesSite = reSiteUsage.Match(templateContent)
+	t.usesPage = rePageUsage.Match(templateContent)
+	_, err = t.template.Parse(string(templateContent))
+	return t, err
+}
+
+// forPage returns a copy of the template bound to the page being rendered,
+// so template functions can record what the page depends on with
+// --incremental. Otherwise the template is shared by all pages, unless it
+// uses functions which need the page.
+func (t *PlyTemplate) forPage(r *pageRender) (*PlyTemplate, error) {
+	if !t.site.incremental && !t.usesPage {
+		return t, nil
+	}
+	return t.bind(r.Path, r.deps, &r.log)
+}
+
+func (t *PlyTemplate) bind(from *Path, deps *pageDeps, log *bytes.Buffer) (*PlyTemplate, error) {
+	bound := *t
+	bound.from = from
+	bound.deps = deps
+	bound.log = log
+
+	clone, err := t.template.Clone()
 	if err != nil {
-		return t, err
+		return nil, err
 	}
+	bound.template = clone.Funcs(bound.templateFnMap())
+	return &bound, nil
+}
 
-	_, err = t.template.Parse(string(templateContent))
-	return t, err
+func (t *PlyTemplate) dependsOn(absPath string) {
+	if t.deps != nil {
+		t.deps.addFile(absPath)
+	}
+}
+
+func (t *PlyTemplate) dependsOnSite() {
+	if t.deps != nil {
+		t.deps.Site = true
+	}
+}
+
+// dependsOnAnything marks output that can't be tracked, like directory
+// listings and command output
+func (t *PlyTemplate) dependsOnAnything() {
+	if t.deps != nil {
+		t.deps.Volatile = true
+	}
+}
+
+// out is where template functions log to. Output for a page is collected
+// and printed when the page is done, so parallel renders don't interleave.
+func (t *PlyTemplate) out() io.Writer {
+	if t.log != nil {
+		return t.log
+	}
+	return os.Stdout
+}
+
+func (t *PlyTemplate) wrote(absPath string) {
+	if t.deps != nil {
+		t.deps.addOutput(absPath)
+	}
 }
 
 func (t *PlyTemplate) templateFnMap() template.FuncMap {
@@ -60,8 +161,18 @@ func (t *PlyTemplate) templateFnMap() template.FuncMap {
 		"templateWrite":     t.TemplateWrite,
 		"yamlRead":          t.YamlRead,
 		"yamlWrite":         t.YamlWrite,
+		"yamlParse":         t.YamlParse,
+		"toYAML":            t.ToYaml,
+		"jsonRead":          t.JsonRead,
+		"jsonWrite":         t.JsonWrite,
+		"jsonParse":         t.JsonParse,
+		"toJSON":            t.ToJson,
+		"tomlRead":          t.TomlRead,
+		"csvRead":           t.CsvRead,
 		"stringsJoin":       t.StringsJoin,
 		"stringsSplit":      strings.Split,
+		"slugify":           slugify,
+		"ref":               t.Ref,
 		"array":             t.Array,
 		"timeNow":           t.TimeNow,
 		"timeFormat":        t.TimeFormat,
@@ -69,12 +180,14 @@ func (t *PlyTemplate) templateFnMap() template.FuncMap {
 		"mathInc":           t.MathInc,
 		"mathDec":           t.MathDec,
 		"exec":              t.Exec,
+		"highlightCss":      t.HighlightCss,
+		"searchIndexUrl":    t.SearchIndexUrl,
 		"null":              t.Null,
 	}
 }
 
 func (t *PlyTemplate) AbsRelToTemplate(url string) (string, error) {
-	return fileutil.AbsRootLimit(t.site.TargetPath, filepath.Join(filepath.Dir(t.path), url))
+	return fileutil.AbsRootLimit(t.site.TargetPath, filepath.Join(t.dir, url))
 }
 
 func (t *PlyTemplate) ListDirs(url string, recursive bool) (map[string]string, error) {
@@ -90,6 +203,7 @@ func (t *PlyTemplate) listFiles(url string, dirNotFile bool, recursive bool) (ma
 	if err != nil {
 		return nil, err
 	}
+	t.dependsOnAnything()
 
 	list := make(map[string]string)
 	walkFn := func(subpath string, info os.FileInfo, err error) error {
@@ -126,6 +240,7 @@ func (t *PlyTemplate) listFiles(url string, dirNotFile bool, recursive bool) (ma
 }
 
 func (t *PlyTemplate) HasPage(url string) bool {
+	t.dependsOnSite()
 	for _, p := range t.site.Pages {
 		if p.Path.Url() == url {
 			return true
@@ -140,6 +255,7 @@ func (t *PlyTemplate) HasFile(url string) bool {
 	if err != nil {
 		return false
 	}
+	t.dependsOnAnything()
 
 	_, err = os.Stat(absPath)
 	return os.IsExist(err)
@@ -155,6 +271,7 @@ func (t *PlyTemplate) Include(url string) (string, error) {
 		return "", err
 	}
 
+	t.dependsOn(absPath)
 	content, err := ioutil.ReadFile(absPath)
 	if err != nil {
 		return "", err
@@ -169,6 +286,10 @@ func (t *PlyTemplate) TemplateImport(url, name string) (string, error) {
 		return "", err
 	}
 
+	if reSiteUsage.MatchString(content) {
+		t.dependsOnSite()
+	}
+
 	_, err = t.template.New(name).Parse(content)
 	return "", err
 }
@@ -190,17 +311,24 @@ func (t *PlyTemplate) TemplateWrite(name, url string, data interface{}) (string,
 		return "", err
 	}
 
-	fmt.Println("File from template", name+":", absPath)
+	fmt.Fprintln(t.out(), "File from template", name+":", absPath)
+	t.wrote(absPath)
 	return "", ioutil.WriteFile(absPath, buf.Bytes(), 0644)
 }
 
-func (t *PlyTemplate) YamlRead(url string) (data YamlData, err error) {
+// readFile reads a file relative to the template, which the page depends on
+func (t *PlyTemplate) readFile(url string) ([]byte, error) {
 	absPath, err := t.AbsRelToTemplate(url)
 	if err != nil {
-		return data, err
+		return nil, err
 	}
 
-	content, err := ioutil.ReadFile(absPath)
+	t.dependsOn(absPath)
+	return ioutil.ReadFile(absPath)
+}
+
+func (t *PlyTemplate) YamlRead(url string) (data YamlData, err error) {
+	content, err := t.readFile(url)
 	if err != nil {
 		return data, err
 	}
@@ -220,12 +348,104 @@ func (t *PlyTemplate) YamlWrite(url string, data YamlData) (string, error) {
 		return "", err
 	}
 
+	t.wrote(absPath)
 	return "", ioutil.WriteFile(absPath, content, 0644)
 }
 
+func (t *PlyTemplate) YamlParse(content string) (data interface{}, err error) {
+	err = yaml.Unmarshal([]byte(content), &data)
+	return data, err
+}
+
+func (t *PlyTemplate) ToYaml(data interface{}) (string, error) {
+	content, err := yaml.Marshal(data)
+	return string(content), err
+}
+
+func (t *PlyTemplate) JsonRead(url string) (interface{}, error) {
+	content, err := t.readFile(url)
+	if err != nil {
+		return nil, err
+	}
+	return decodeData(".json", content)
+}
+
+func (t *PlyTemplate) JsonWrite(url string, data interface{}) (string, error) {
+	absPath, err := t.AbsRelToTemplate(url)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.MarshalIndent(jsonCompatible(data), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	t.wrote(absPath)
+	return "", ioutil.WriteFile(absPath, append(content, '\n'), 0644)
+}
+
+func (t *PlyTemplate) JsonParse(content string) (interface{}, error) {
+	return decodeData(".json", []byte(content))
+}
+
+func (t *PlyTemplate) ToJson(data interface{}) (string, error) {
+	content, err := json.Marshal(jsonCompatible(data))
+	return string(content), err
+}
+
+func (t *PlyTemplate) TomlRead(url string) (interface{}, error) {
+	content, err := t.readFile(url)
+	if err != nil {
+		return nil, err
+	}
+	return decodeData(".toml", content)
+}
+
+// CsvRead returns the rows of a CSV file as maps keyed by the header row
+func (t *PlyTemplate) CsvRead(url string) (interface{}, error) {
+	content, err := t.readFile(url)
+	if err != nil {
+		return nil, err
+	}
+	return decodeData(".csv", content)
+}
+
+// jsonCompatible converts the map[interface{}]interface{} maps of YAML data
+// to map[string]interface{}, which encoding/json can marshal
+func jsonCompatible(data interface{}) interface{} {
+	switch value := data.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = jsonCompatible(v)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[k] = jsonCompatible(v)
+		}
+		return m
+	case YamlData:
+		return jsonCompatible(map[string]interface{}(value))
+	case []interface{}:
+		s := make([]interface{}, len(value))
+		for i, v := range value {
+			s[i] = jsonCompatible(v)
+		}
+		return s
+	}
+	return data
+}
+
 var regexCache map[string]*regexp.Regexp
+var regexCacheLock sync.Mutex
 
 func (t *PlyTemplate) RegexCompileCache(pattern string) (*regexp.Regexp, error) {
+	regexCacheLock.Lock()
+	defer regexCacheLock.Unlock()
+
 	if regexCache == nil {
 		regexCache = make(map[string]*regexp.Regexp)
 	}
@@ -308,10 +528,11 @@ func (t *PlyTemplate) MathDec(i int) int {
 
 func (t *PlyTemplate) Exec(name string, arg ...string) (string, error) {
 
-	fmt.Print("Executing command: " + name + " " + strings.Join(arg, " ") + " ... ")
+	fmt.Fprint(t.out(), "Executing command: "+name+" "+strings.Join(arg, " ")+" ... ")
+	t.dependsOnAnything()
 
 	if !t.site.allowExec {
-		fmt.Println("BLOCKED! Use --allow-exec to allow command execution in templates")
+		fmt.Fprintln(t.out(), "BLOCKED! Use --allow-exec to allow command execution in templates")
 		return "", nil
 	}
 
@@ -348,15 +569,41 @@ func (t *PlyTemplate) Exec(name string, arg ...string) (string, error) {
 	byteerr, _ := ioutil.ReadAll(stderr)
 
 	if err := cmd.Wait(); err != nil {
-		fmt.Println("FAILED: " + err.Error())
-		fmt.Println("OUTPUT: " + string(byteerr))
+		fmt.Fprintln(t.out(), "FAILED: "+err.Error())
+		fmt.Fprintln(t.out(), "OUTPUT: "+string(byteerr))
 		return "", err
 	}
 
-	fmt.Println("SUCCESS")
+	fmt.Fprintln(t.out(), "SUCCESS")
 	return string(byteout), nil
 }
 
+// Ref returns a link to the page with an identifier, see indexRefs
+func (t *PlyTemplate) Ref(name string) (string, error) {
+	t.dependsOnSite()
+	if t.from == nil {
+		p, err := t.site.ref(name)
+		if err != nil {
+			return "", err
+		}
+		return p.Path.Url(), nil
+	}
+	return t.site.refLink(t.from, name)
+}
+
+func (t *PlyTemplate) HighlightCss() (string, error) {
+	return t.site.highlightCss()
+}
+
+// SearchIndexUrl returns a link to search.json, written with --search
+func (t *PlyTemplate) SearchIndexUrl() string {
+	absPath := filepath.Join(t.site.TargetPath, searchIndexFile)
+	if t.from == nil {
+		return t.site.rootUrlOf(absPath)
+	}
+	return t.from.UrlToAbs(absPath)
+}
+
 func (t *PlyTemplate) Null(arg ...interface{}) string {
 	return ""
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var watchInterval time.Duration = 500 * time.Millisecond
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+type sourceSnapshot map[string]fileState
+
+func (a sourceSnapshot) equal(b sourceSnapshot) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, ok := b[path]; !ok || !other.modTime.Equal(state.modTime) || other.size != state.size {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch polls the source tree and rebuilds the site whenever something
+// changes. Build errors and broken links are reported, but never stop the
+// watcher. The optional rebuilt callback is called after every successful
+// rebuild.
+func (site *Site) Watch(rebuilt func()) error {
+	return site.watch(rebuilt, nil)
+}
+
+// watch is Watch, until stop is closed
+func (site *Site) watch(rebuilt func(), stop <-chan bool) error {
+	previous, err := site.snapshot()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Watching for changes in", site.SourcePath)
+	for {
+		select {
+		case <-time.After(watchInterval):
+		case <-stop:
+			return nil
+		}
+
+		current, err := site.snapshot()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			continue
+		}
+		if current.equal(previous) {
+			continue
+		}
+
+		// Wait for a burst of changes (e.g. editor save, git checkout) to settle
+		for {
+			time.Sleep(watchInterval)
+			next, err := site.snapshot()
+			if err == nil && next.equal(current) {
+				break
+			}
+			current = next
+		}
+		previous = current
+
+		fmt.Println("Change detected, rebuilding ...")
+		if err := site.configure(); err != nil {
+			fmt.Println("ERROR:", err)
+		} else if err := site.Build(); err != nil {
+			fmt.Println("ERROR:", err)
+		} else {
+			fmt.Println(len(site.Pages), "pages")
+			if _, err := site.reportBrokenLinks(); err != nil {
+				fmt.Println("ERROR:", err)
+			}
+			if rebuilt != nil {
+				rebuilt()
+			}
+		}
+	}
+}
+
+func (site *Site) snapshot() (sourceSnapshot, error) {
+	snapshot := make(sourceSnapshot)
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(path, site.plyPath) {
+			for _, regex := range site.copyOptions.IgnoreRegex {
+				if regex.MatchString(path) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+		}
+
+		if !info.IsDir() {
+			snapshot[path] = fileState{info.ModTime(), info.Size()}
+		}
+		return nil
+	}
+
+	if err := filepath.Walk(site.SourcePath, walkFn); err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(site.plyPath); err == nil && info.IsDir() {
+		if err := filepath.Walk(site.plyPath, walkFn); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}